@@ -2,13 +2,17 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
 	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/core"
 	"github.com/hinha/watchgo/fswatch"
+	"github.com/hinha/watchgo/index"
 	"github.com/hinha/watchgo/logger"
 	"log"
+	"net/http"
 	"os"
 )
 
@@ -20,24 +24,57 @@ var (
 	docs    string
 )
 
+// command is the sub command given as first argument, the daemon runs when
+// it is empty.
+var command string
+
+// commands sub commands, they receive the arguments left after the flags.
+var commands = map[string]func(args []string) error{
+	"versions": versionsCmd,
+	"restore":  restoreCmd,
+}
+
+// commandFlags are the flag sets of the sub commands with their own flags,
+// the common flags are added to them.
+var commandFlags = map[string]*flag.FlagSet{
+	"restore": restoreFlags,
+}
+
+// commandArgs are the arguments of the sub command left after the flags.
+var commandArgs []string
+
 func init() {
 	if len(os.Args) == 2 && (os.Args[1] == "--version" || os.Args[1] == "-v" || os.Args[1] == "ver") {
 		printVersion()
 		os.Exit(0)
 	}
 
-	flag.BoolVar(&config.Debug, "debug", false, "examples --debug=true")
-	flag.StringVar(&config.File, "c", "/etc/watchgo/config.yml", "examples --c=config.yml")
-	flag.Parse()
+	args := os.Args[1:]
+	if len(args) > 0 && commands[args[0]] != nil {
+		command, args = args[0], args[1:]
+	}
+
+	flags := flag.CommandLine
+	if fs, ok := commandFlags[command]; ok {
+		flags = fs
+	}
+	flags.BoolVar(&config.Debug, "debug", false, "examples --debug=true")
+	flags.StringVar(&config.File, "c", "/etc/watchgo/config.yml", "examples --c=config.yml")
+	_ = flags.Parse(args)
+	commandArgs = flags.Args()
 
 	// print help
 	if len(os.Args) < 2 {
-		log.Printf("Usage: %s -options=param\n\n", config.AppName)
+		log.Printf("Usage: %s -options=param\n", config.AppName)
+		log.Printf("       %s versions -options=param <path>\n", config.AppName)
+		log.Printf("       %s restore -options=param <path>\n\n", config.AppName)
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
 
-	printVersion()
+	if command == "" {
+		printVersion()
+	}
 
 	if err := config.LoadConfig(config.File); err != nil {
 		log.Fatalf("fatal open config file %s, error: %s\n", config.File, err)
@@ -47,6 +84,13 @@ func init() {
 }
 
 func main() {
+	if command != "" {
+		if err := commands[command](commandArgs); err != nil {
+			log.Fatalf("%s: %s\n", command, err)
+		}
+		return
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -77,14 +121,32 @@ func main() {
 	done := make(chan struct{}, 1)
 	defer close(done)
 
-	fswatch.NewEvent(ctx).Run(c)
+	// without index a sync hashes every file
+	idx, err := index.Open(config.General.IndexFile)
+	if err != nil {
+		logger.Error().Str("path", config.General.IndexFile).Err(err).Msg("open index")
+	}
+	defer idx.Close()
+
+	// the watcher metrics are published by expvar
+	if config.General.MetricsListen != "" {
+		go func() {
+			if err := http.ListenAndServe(config.General.MetricsListen, expvar.Handler()); err != nil {
+				logger.Error().Str("listen", config.General.MetricsListen).Err(err).Msg("metrics")
+			}
+		}()
+	}
+
+	dests := core.NewDestinations(config.FileSystemCfg.Backup, idx)
 
-	watcher := &fswatch.FSWatcher{Events: watch.Events}
+	watcher := &fswatch.FSWatcher{Events: c, Destinations: dests, Index: idx}
+
+	fswatch.NewEvent(ctx, dests, idx).Run(c, watcher)
 
-	watcher.FSWatcherStart(ctx, watch)
 	defer watch.Close()
 
-	// Process events
+	// Process events, drained before the watches are added so the queue of
+	// the kernel does not overflow during the initial sync
 	go func() {
 		for {
 			select {
@@ -94,10 +156,14 @@ func main() {
 				return
 			case ev := <-watch.Events:
 				c <- ev
+			case err := <-watch.Errors:
+				watcher.Error(err)
 			}
 		}
 	}()
 
+	watcher.FSWatcherStart(ctx, watch)
+
 	_, ok := <-done
 	if ok {
 		logger.Info(0).Msg("exit.")
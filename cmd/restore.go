@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/core"
+	"github.com/hinha/watchgo/storage"
+)
+
+// restoreFlags are the flags of the restore sub command, the daemon does not
+// accept them.
+var restoreFlags = flag.NewFlagSet("restore", flag.ExitOnError)
+
+var (
+	restoreTo        = restoreFlags.String("to", "", "alternate directory, examples --to=/tmp/restore")
+	restoreDryRun    = restoreFlags.Bool("dry-run", false, "print the files without writing them")
+	restoreOverwrite = restoreFlags.String("overwrite", "never", "existing files never, always or newer")
+	restoreAt        = restoreFlags.String("at", "", "point in time, examples --at=2022-11-20T15:04:05")
+	restoreDest      = restoreFlags.String("dest", "", "destination name, Default value - first with the files")
+	restoreFormat    = restoreFlags.String("format", "original", "converted images as original or stored format")
+)
+
+// restoreFile is a backup selected for restoring.
+type restoreFile struct {
+	name    string
+	target  string
+	modTime time.Time
+}
+
+// restoreCmd restores a source file or folder from a backup destination.
+func restoreCmd(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s restore -c=config.yml [-to=dir] [-dry-run] [-overwrite=never|always|newer] [-at=time] [-format=original|stored] <path>", config.AppName)
+	}
+
+	switch *restoreOverwrite {
+	case "never", "always", "newer":
+	default:
+		return fmt.Errorf("unknown overwrite policy %q", *restoreOverwrite)
+	}
+	if *restoreFormat != "original" && *restoreFormat != "stored" {
+		return fmt.Errorf("unknown restore format %q", *restoreFormat)
+	}
+
+	at := time.Now()
+	if *restoreAt != "" {
+		t, err := parseTime(*restoreAt)
+		if err != nil {
+			return err
+		}
+		at = t
+	}
+
+	lPath, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	name := core.BackupName(lPath)
+
+	for _, d := range core.NewDestinations(config.FileSystemCfg.Backup, nil) {
+		if *restoreDest != "" && d.Name != *restoreDest {
+			continue
+		}
+
+		store, err := d.Storage()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", d.Name, err)
+			continue
+		}
+
+		files, err := selectRestore(store, name, lPath, at)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			continue
+		}
+
+		fmt.Printf("restore %d files from %s\n", len(files), d.Name)
+		var failed int
+		for _, f := range files {
+			if err := restore(store, f); err != nil {
+				failed++
+				fmt.Fprintf(os.Stderr, "error %s: %s\n", f.target, err)
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d files failed", failed, len(files))
+		}
+		return nil
+	}
+	return fmt.Errorf("no backup of %s found", lPath)
+}
+
+// selectRestore returns the backups of name, a single file or everything
+// below it, stored at or before at.
+func selectRestore(store storage.Storage, name, lPath string, at time.Time) ([]restoreFile, error) {
+	target := func(n string) string {
+		rel := filepath.FromSlash(strings.TrimPrefix(strings.TrimPrefix(n, name), "/"))
+		if *restoreTo != "" {
+			return filepath.Join(*restoreTo, filepath.Base(lPath), rel)
+		}
+		return filepath.Join(lPath, rel)
+	}
+
+	var names []string
+	if versioner, ok := storage.AsVersioner(store); ok {
+		revs, err := versioner.Revisions(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(revs) > 0 {
+			names = append(names, name)
+		} else if err := versioner.History(name, func(n string) error {
+			names = append(names, n)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := store.Stat(name); err == nil {
+			names = append(names, name)
+		} else if err := store.List(name, func(obj storage.Object) error {
+			names = append(names, obj.Name)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	var files []restoreFile
+	for _, n := range names {
+		rev, err := revisionAt(store, n, at)
+		if errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("skip %s, no backup at %s\n", n, at.Format(time.RFC3339))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, restoreFile{name: rev.Name, target: target(n), modTime: rev.Time})
+	}
+	return files, nil
+}
+
+// revisionAt returns the newest revision of name stored at or before at.
+func revisionAt(store storage.Storage, name string, at time.Time) (storage.Revision, error) {
+	versioner, ok := storage.AsVersioner(store)
+	if !ok {
+		obj, err := store.Stat(name)
+		if err != nil {
+			return storage.Revision{}, err
+		}
+		if obj.ModTime.After(at) {
+			return storage.Revision{}, fs.ErrNotExist
+		}
+		return storage.Revision{Object: obj, Time: obj.ModTime, Current: true}, nil
+	}
+
+	revs, err := versioner.Revisions(name)
+	if err != nil {
+		return storage.Revision{}, err
+	}
+	for _, rev := range revs {
+		if !rev.Time.After(at) {
+			return rev, nil
+		}
+	}
+	return storage.Revision{}, fs.ErrNotExist
+}
+
+// restore writes a backup to its target according to the overwrite policy.
+// A converted image is re-encoded to its original format or written with the
+// extension of the stored format.
+func restore(store storage.Storage, f restoreFile) error {
+	obj, err := store.Stat(f.name)
+	if err != nil {
+		return err
+	}
+	format := obj.Metadata[storage.MetaFormat]
+	if format != "" && *restoreFormat == "stored" {
+		f.target = strings.TrimSuffix(f.target, filepath.Ext(f.target)) + core.ConvertExt(format)
+	}
+
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(f.target); err == nil {
+		mode = fi.Mode().Perm()
+		switch {
+		case *restoreOverwrite == "never":
+			fmt.Printf("skip %s, file exists\n", f.target)
+			return nil
+		case *restoreOverwrite == "newer" && !f.modTime.After(fi.ModTime()):
+			fmt.Printf("skip %s, file is newer than the backup\n", f.target)
+			return nil
+		}
+	}
+
+	fmt.Printf("restore %s -> %s (%s)\n", path.Clean(f.name), f.target, f.modTime.Local().Format(time.RFC3339))
+	if *restoreDryRun {
+		return nil
+	}
+
+	rc, err := store.Open(f.name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := os.MkdirAll(filepath.Dir(f.target), os.ModePerm); err != nil {
+		return err
+	}
+
+	// write next to the target, an interrupted restore keeps the old file
+	tmp, err := os.CreateTemp(filepath.Dir(f.target), "."+filepath.Base(f.target)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if format != "" && *restoreFormat == "original" {
+		err = core.Reencode(tmp, rc, format, obj.Metadata[storage.MetaOriginalFormat], config.FileSystemCfg.Compress.Quality)
+	} else {
+		_, err = io.Copy(tmp, rc)
+	}
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.target); err != nil {
+		return err
+	}
+	return os.Chtimes(f.target, f.modTime, f.modTime)
+}
+
+// parseTime accepts RFC 3339 and shorter local times.
+func parseTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/core"
+	"github.com/hinha/watchgo/storage"
+	"github.com/hinha/watchgo/utils"
+)
+
+// versionsCmd prints the revisions of a source path in every destination.
+func versionsCmd(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s versions -c=config.yml <path>", config.AppName)
+	}
+
+	lPath, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	name := core.BackupName(lPath)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "DESTINATION\tTIME\tSIZE\tNAME")
+
+	for _, d := range core.NewDestinations(config.FileSystemCfg.Backup, nil) {
+		store, err := d.Storage()
+		if err != nil {
+			fmt.Fprintf(w, "%s\terror: %s\t\t\n", d.Name, err)
+			continue
+		}
+
+		versioner, ok := storage.AsVersioner(store)
+		if !ok {
+			obj, err := store.Stat(name)
+			if err == nil {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s (current)\n", d.Name, obj.ModTime.Local().Format(time.RFC3339), utils.ByteSize(obj.Size), obj.Name)
+			}
+			continue
+		}
+
+		revs, err := versioner.Revisions(name)
+		if err != nil {
+			fmt.Fprintf(w, "%s\terror: %s\t\t\n", d.Name, err)
+			continue
+		}
+		for _, rev := range revs {
+			label := rev.Name
+			if rev.Current {
+				label += " (current)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.Name, rev.Time.Local().Format(time.RFC3339), utils.ByteSize(rev.Size), label)
+		}
+	}
+	return nil
+}
@@ -32,25 +32,232 @@ type config struct {
 		ErrorLog     string `yaml:"error_log"`
 		InfoLog      string `yaml:"info_log"`
 		PidFile      string `yaml:"pid_file"`
+		// IndexFile is the index database of the watched files and their
+		// backups, empty disables it.
+		IndexFile string `yaml:"index_file"`
+		// MetricsListen is the address the watcher metrics are served on,
+		// empty disables it.
+		MetricsListen string `yaml:"metrics_listen"`
 	} `yaml:"general"`
 	FileSystem FileSystemConfig `yaml:"file_system"`
 }
 
 type FileSystemConfig struct {
-	Paths       []string       `yaml:"paths"`
-	Compress    CompressConfig `yaml:"compress"`
-	MaxFileSize int64          `yaml:"max_file_size"`
-	Backup      struct {
-		HardDrivePath string   `yaml:"hard_drive_path"`
-		Prefix        []string `yaml:"prefix"`
-	} `yaml:"backup"`
+	Paths       []PathConfig    `yaml:"paths"`
+	Compress    CompressConfig  `yaml:"compress"`
+	MaxFileSize int64           `yaml:"max_file_size"`
+	Backup      BackupConfig    `yaml:"backup"`
+	Thumbnails  ThumbnailConfig `yaml:"thumbnails"`
+	Sync        SyncConfig      `yaml:"sync"`
+	Events      EventsConfig    `yaml:"events"`
 }
 
-type CompressConfig struct {
+// PathList returns the watched paths.
+func (f FileSystemConfig) PathList() []string {
+	paths := make([]string, len(f.Paths))
+	for i, p := range f.Paths {
+		paths[i] = p.Path
+	}
+	return paths
+}
+
+// PathConfig is a watched path, a plain string in paths is a path with Mode
+// watch. Mode poll scans a path on a filesystem which does not report
+// events, NFS, SMB or FUSE, every Interval seconds, Default value - 60.
+type PathConfig struct {
+	Path     string `yaml:"path"`
+	Mode     string `yaml:"mode"`
+	Interval int    `yaml:"interval"`
+}
+
+// UnmarshalYAML reads a path given as plain string or with its options.
+func (p *PathConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&p.Path); err == nil {
+		return nil
+	}
+
+	type plain PathConfig
+	return unmarshal((*plain)(p))
+}
+
+// EventsConfig how changes of the watched files reach the destinations. A
+// created file, with Write a written file too, is backed up once its size and
+// modification time did not change for Debounce seconds, Default value - 2.
+// The writes of a created file are backed up for 10 minutes after its last
+// change whatever Write.
+// Rename backup, move or record, Default value - backup. Remove keep, trash
+// or mirror, Default value - keep. A trashed backup is deleted after
+// TrashRetention days, Default value - 30. On Linux Fanotify watches the
+// whole filesystems of the paths with one mark each, it falls back to inotify
+// without the privileges.
+type EventsConfig struct {
+	Write          bool   `yaml:"write"`
+	Debounce       int    `yaml:"debounce"`
+	Rename         string `yaml:"rename"`
+	Remove         string `yaml:"remove"`
+	TrashRetention int    `yaml:"trash_retention"`
+	Fanotify       bool   `yaml:"fanotify"`
+}
+
+// SyncConfig of the periodic sync. Mode incremental only hashes a file which
+// size or modification time, and with Inode its inode, changed since the last
+// sync, it needs general.index_file. Mode full hashes every file. An
+// incremental sync scrubs, it hashes every file, every ScrubInterval hours,
+// Default value - 168.
+type SyncConfig struct {
+	Mode          string `yaml:"mode"`
+	Inode         bool   `yaml:"inode"`
+	ScrubInterval int    `yaml:"scrub_interval"`
+}
+
+// ThumbnailConfig writes a JPEG thumbnail of every backed up image into
+// ".thumbs", Size is the longest edge in pixels, Default value - 256, Quality
+// Default value - 75.
+type ThumbnailConfig struct {
 	Enabled bool `yaml:"enabled"`
+	Size    int  `yaml:"size"`
 	Quality int  `yaml:"quality"`
 }
 
+type BackupConfig struct {
+	DestinationConfig `yaml:",inline"`
+	Destinations      []DestinationConfig `yaml:"destinations"`
+}
+
+// DestinationList returns the configured destinations, the legacy single
+// destination of the backup section is used when the list is empty.
+func (b BackupConfig) DestinationList() []DestinationConfig {
+	if len(b.Destinations) > 0 {
+		return b.Destinations
+	}
+	return []DestinationConfig{b.DestinationConfig}
+}
+
+type DestinationConfig struct {
+	Name          string     `yaml:"name"`
+	Type          string     `yaml:"type"`
+	HardDrivePath string     `yaml:"hard_drive_path"`
+	S3            S3Config   `yaml:"s3"`
+	SFTP          SFTPConfig `yaml:"sftp"`
+	Prefix        []string   `yaml:"prefix"`
+	// Format of the repository, plain copies or deduplicated chunks.
+	Format string `yaml:"format"`
+	// Compress overrides compress.enabled for this destination.
+	Compress   *bool            `yaml:"compress"`
+	Versioning VersioningConfig `yaml:"versioning"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+}
+
+// EncryptionConfig encrypts the backups with a key file of at least 32 random
+// bytes or a passphrase file. AllowPlain reads the objects stored before
+// encryption was enabled, they fail to open otherwise.
+type EncryptionConfig struct {
+	Enabled        bool   `yaml:"enabled"`
+	KeyFile        string `yaml:"key_file"`
+	PassphraseFile string `yaml:"passphrase_file"`
+	EncryptNames   bool   `yaml:"encrypt_names"`
+	AllowPlain     bool   `yaml:"allow_plain"`
+}
+
+// VersioningConfig keeps the previous content of replaced backups, a zero
+// retention keeps every revision.
+type VersioningConfig struct {
+	Enabled     bool `yaml:"enabled"`
+	KeepLast    int  `yaml:"keep_last"`
+	KeepDaily   int  `yaml:"keep_daily"`
+	KeepMonthly int  `yaml:"keep_monthly"`
+}
+
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	UseSSL    bool   `yaml:"use_ssl"`
+	PartSize  uint64 `yaml:"part_size"`
+}
+
+type SFTPConfig struct {
+	Host                  string `yaml:"host"`
+	Port                  int    `yaml:"port"`
+	User                  string `yaml:"user"`
+	Password              string `yaml:"password"`
+	PrivateKey            string `yaml:"private_key"`
+	KnownHosts            string `yaml:"known_hosts"`
+	InsecureIgnoreHostKey bool   `yaml:"insecure_ignore_host_key"`
+	Path                  string `yaml:"path"`
+	MaxConns              int    `yaml:"max_conns"`
+}
+
+type CompressConfig struct {
+	Enabled  bool               `yaml:"enabled"`
+	Quality  int                `yaml:"quality"`
+	Engine   string             `yaml:"engine"`
+	Convert  ConvertConfig      `yaml:"convert"`
+	Metadata MetadataConfig     `yaml:"metadata"`
+	Files    FileCompressConfig `yaml:"files"`
+	// KeepOriginal stores the source bytes of an image and the compressed
+	// image as preview in ".previews".
+	KeepOriginal bool `yaml:"keep_original"`
+	// Preview adds a JPEG preview to an image stored untouched, RAW, HEIC or
+	// TIFF.
+	Preview bool `yaml:"preview"`
+	// Handlers routes a file extension to a handler, image, original, pdf,
+	// video or file.
+	Handlers map[string]string `yaml:"handlers"`
+	PDF      PDFConfig         `yaml:"pdf"`
+	Video    VideoConfig       `yaml:"video"`
+}
+
+// VideoConfig transcodes a video of at least MinSize megabyte, Default value -
+// max_file_size, with Command, Default value - ffmpeg, to Codec, Default
+// value - libx265, and Bitrate, Default value - 4M. A video larger than
+// MaxSize megabyte is rejected, Default value - 4096.
+type VideoConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Command string `yaml:"command"`
+	Codec   string `yaml:"codec"`
+	Bitrate string `yaml:"bitrate"`
+	MinSize int64  `yaml:"min_size"`
+	MaxSize int64  `yaml:"max_size"`
+}
+
+// PDFConfig optimises documents with Optimizer gs or qpdf, gs downsamples the
+// embedded images to DPI, Default value - 150.
+type PDFConfig struct {
+	Optimizer string `yaml:"optimizer"`
+	DPI       int    `yaml:"dpi"`
+}
+
+// ConvertConfig stores JPEG and PNG backups as Format, webp or avif, with
+// Quality, Default value - compress.quality.
+type ConvertConfig struct {
+	Format  string `yaml:"format"`
+	Quality int    `yaml:"quality"`
+}
+
+// MetadataConfig is what a re-encoded image keeps of the metadata of its
+// source, Policy keep, allowlist or strip. Tags are the EXIF tag names, GPS,
+// ICC and XMP an allowlist keeps.
+type MetadataConfig struct {
+	Policy string   `yaml:"policy"`
+	Tags   []string `yaml:"tags"`
+}
+
+// FileCompressConfig stream compression of files which are not images. A
+// file with a codec in Extensions is always compressed, other files from
+// MinSize kilobyte on with Codec.
+type FileCompressConfig struct {
+	Enabled        bool              `yaml:"enabled"`
+	Codec          string            `yaml:"codec"`
+	Level          int               `yaml:"level"`
+	MinSize        int64             `yaml:"min_size"`
+	Extensions     map[string]string `yaml:"extensions"`
+	SkipExtensions []string          `yaml:"skip_extensions"`
+}
+
 // LoadConfig Read and parse config file.
 func LoadConfig(configFile string) error {
 	filename, err := filepath.Abs(configFile)
@@ -0,0 +1,283 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/storage"
+)
+
+// rename policies of events.rename.
+const (
+	renameBackup = "backup"
+	renameMove   = "move"
+	renameRecord = "record"
+)
+
+// remove policies of events.remove.
+const (
+	removeKeep   = "keep"
+	removeTrash  = "trash"
+	removeMirror = "mirror"
+)
+
+// defaultTrashRetention days a trashed backup is kept.
+const defaultTrashRetention = 30
+
+// objects returns the backup name of a file or, for a folder, the backups
+// below it.
+func objects(store storage.Storage, name string) ([]string, error) {
+	_, err := store.Stat(name)
+	if err == nil {
+		return []string{name}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	var names []string
+	err = store.List(name, func(obj storage.Object) error {
+		if strings.HasPrefix(obj.Name, name+"/") {
+			names = append(names, obj.Name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// derived returns the preview and thumbnail names of the object name.
+func derived(name string) []string {
+	return []string{storage.PreviewName(name), storage.ThumbName(name)}
+}
+
+// exists reports whether store has an object name.
+func exists(store storage.Storage, name string) (bool, error) {
+	_, err := store.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Rename moves the backups of oldPath, previews and thumbnails included, to
+// the name of newPath. A backup already stored under the new name is kept as
+// revision by a versioned destination, otherwise the backup is not moved and
+// the new name is backed up again. It reports false when no backup was moved.
+func (d *Destination) Rename(oldPath, newPath string) (bool, error) {
+	store, err := d.Storage()
+	if err != nil {
+		return false, err
+	}
+
+	oldName, newName := BackupName(oldPath), BackupName(newPath)
+	names, err := objects(store, oldName)
+	if err != nil || len(names) == 0 {
+		return false, err
+	}
+
+	_, versioned := storage.AsVersioner(store)
+	moved := false
+	for _, name := range names {
+		rel := strings.TrimPrefix(name, oldName)
+		target := newName + rel
+		if !versioned {
+			ok, err := exists(store, target)
+			if err != nil {
+				return moved, err
+			}
+			if ok {
+				logger.Warn().Str("destination", d.Name).Str("from", name).Str("to", target).Msg("backup exists, the old backup is not moved")
+				continue
+			}
+		}
+		if err := storage.Move(store, name, target); err != nil {
+			return true, err
+		}
+		moved = true
+
+		targets := derived(target)
+		for i, src := range derived(name) {
+			ok, err := exists(store, src)
+			if err == nil && ok {
+				err = storage.Move(store, src, targets[i])
+			}
+			if err != nil {
+				return true, err
+			}
+		}
+
+		local := filepath.FromSlash(rel)
+		if err := d.index.PutRenamed(oldPath+local, newPath+local, d.Name, target, time.Now()); err != nil {
+			logger.Error().Str("destination", d.Name).Str("path", newPath+local).Err(err).Msg("index backup")
+		}
+	}
+	if moved {
+		logger.Info(0).Str("destination", d.Name).Str("path", newPath).Str("from", oldName).Str("to", newName).Msg("move backup is done")
+	}
+	return moved, nil
+}
+
+// Record keeps the backups of oldPath where they are and records them in the
+// index as backups of newPath. It reports false when oldPath has no backup.
+func (d *Destination) Record(oldPath, newPath string) (bool, error) {
+	store, err := d.Storage()
+	if err != nil {
+		return false, err
+	}
+
+	oldName := BackupName(oldPath)
+	names, err := objects(store, oldName)
+	if err != nil || len(names) == 0 {
+		return false, err
+	}
+
+	for _, name := range names {
+		local := filepath.FromSlash(strings.TrimPrefix(name, oldName))
+		if err := d.index.PutRenamed(oldPath+local, newPath+local, d.Name, name, time.Now()); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// Remove trashes or deletes the backups of the removed lPath by policy, the
+// previews and thumbnails are deleted.
+func (d *Destination) Remove(lPath, policy string) error {
+	store, err := d.Storage()
+	if err != nil {
+		return err
+	}
+
+	names, err := objects(store, BackupName(lPath))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, name := range names {
+		switch policy {
+		case removeTrash:
+			err = storage.Move(store, name, storage.TrashName(name, now))
+		case removeMirror:
+			err = store.Delete(name)
+		default:
+			err = fmt.Errorf("unknown remove policy %q", policy)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, src := range derived(name) {
+			ok, err := exists(store, src)
+			if err == nil && ok {
+				err = store.Delete(src)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		logger.Info(0).Str("destination", d.Name).Str("path", lPath).Str("dstPath", name).Str("policy", policy).Msg("remove backup is done")
+	}
+	return nil
+}
+
+// EmptyTrash deletes the backups trashed before the retention of
+// events.trash_retention.
+func (d *Destination) EmptyTrash() error {
+	store, err := d.Storage()
+	if err != nil {
+		return err
+	}
+
+	days := config.FileSystemCfg.Events.TrashRetention
+	if days <= 0 {
+		days = defaultTrashRetention
+	}
+	return storage.EmptyTrash(store, time.Now().AddDate(0, 0, -days))
+}
+
+// RenameKeepsBackups reports whether events.rename moves or records the
+// backups of a renamed file instead of backing it up again.
+func RenameKeepsBackups() bool {
+	policy := config.FileSystemCfg.Events.Rename
+	return policy == renameMove || policy == renameRecord
+}
+
+// Rename propagates the rename of oldPath to newPath by events.rename. A
+// destination without backup of oldPath backs up newPath, a folder is left to
+// the periodic sync.
+func Rename(dests []*Destination, oldPath, newPath string) {
+	fi, err := os.Stat(newPath)
+	regular := err == nil && fi.Mode().IsRegular()
+
+	policy := config.FileSystemCfg.Events.Rename
+	if policy == "" || policy == renameBackup {
+		if regular {
+			Backup(dests, newPath, SubPath(newPath))
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range dests {
+		if !d.Available() {
+			logger.Debug().Str("destination", d.Name).Str("path", newPath).Msg("skip failing backup destination")
+			continue
+		}
+
+		wg.Add(1)
+		go func(d *Destination) {
+			defer wg.Done()
+
+			var ok bool
+			var err error
+			switch policy {
+			case renameMove:
+				ok, err = d.Rename(oldPath, newPath)
+			case renameRecord:
+				ok, err = d.Record(oldPath, newPath)
+			default:
+				err = fmt.Errorf("unknown rename policy %q", policy)
+			}
+			if err != nil {
+				logger.Error().Str("destination", d.Name).Str("path", newPath).Str("from", oldPath).Err(err).Msg("rename backup")
+				return
+			}
+			if ok || !regular || !d.Match(newPath) {
+				return
+			}
+
+			if err := d.Backup(newPath, SubPath(newPath)); err != nil {
+				logger.Error().Str("destination", d.Name).Str("path", newPath).Err(err).Msg("backup destination failed")
+			}
+		}(d)
+	}
+	wg.Wait()
+}
+
+// Remove propagates the removal of lPath by events.remove, keep leaves the
+// backups untouched.
+func Remove(dests []*Destination, lPath string) {
+	policy := config.FileSystemCfg.Events.Remove
+	if policy == "" || policy == removeKeep {
+		return
+	}
+
+	for _, d := range dests {
+		if !d.Available() {
+			logger.Debug().Str("destination", d.Name).Str("path", lPath).Msg("skip failing backup destination")
+			continue
+		}
+		if err := d.Remove(lPath, policy); err != nil {
+			logger.Error().Str("destination", d.Name).Str("path", lPath).Err(err).Msg("remove backup")
+		}
+	}
+}
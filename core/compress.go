@@ -0,0 +1,212 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/logger"
+)
+
+const (
+	engineGo          = "go"
+	engineImageMagick = "imagemagick"
+)
+
+// errUnsupported is returned by the Go encoder for a format it can not decode.
+var errUnsupported = errors.New("unsupported image format")
+
+// compress recompresses the image at filePath in place. The Go encoder
+// handles JPEG and PNG, ImageMagick is used when it is the configured engine
+// or as fallback for an image the Go encoder can not decode.
+func (c *builder) compress(quality int, filePath string) {
+	duration := time.Now()
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		logger.Error().Str("path", filePath).Err(err).Msg("load file")
+		return
+	}
+	beforeSize := fi.Size()
+
+	engine := config.FileSystemCfg.Compress.Engine
+	if engine == "" {
+		engine = engineGo
+	}
+
+	var done bool
+	if engine == engineGo {
+		done, err = compressGo(quality, filePath)
+		if errors.Is(err, errUnsupported) && hasImageMagick() {
+			engine = engineImageMagick
+		}
+	}
+	if engine == engineImageMagick {
+		done, err = compressImageMagick(quality, filePath)
+	}
+	if err != nil {
+		logger.Error().Str("path", filePath).Str("engine", engine).Err(err).Msg("compress image")
+		return
+	}
+	if !done {
+		logger.Info(time.Since(duration)).Str("path", filePath).Msg("file already compressed")
+		return
+	}
+
+	fl, _ := os.Stat(filePath)
+	afterSize := fl.Size()
+	logger.Info(time.Since(duration)).Str("path", filePath).Str("engine", engine).Msg(fmt.Sprintf("compress file is done, filesize before %d, after %d", beforeSize, afterSize))
+}
+
+// compressGo re-encodes a JPEG with quality or a PNG with the best
+// compression level. The result only replaces filePath when it is smaller.
+func compressGo(quality int, filePath string) (bool, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return false, err
+	}
+
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return false, errUnsupported
+	}
+
+	policy, tags := metadataPolicy()
+	meta := readImageMeta(data).filter(policy, tags)
+
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		if q, err := jpegQuality(bytes.NewReader(data)); err == nil && quality >= q {
+			return false, nil
+		}
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return false, errUnsupported
+		}
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return false, err
+		}
+	case "png":
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return false, errUnsupported
+		}
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		if err := enc.Encode(&buf, img); err != nil {
+			return false, err
+		}
+	default:
+		return false, errUnsupported
+	}
+
+	out := buf.Bytes()
+	if format == "jpeg" {
+		out = injectJPEG(out, meta)
+	} else {
+		out = injectPNG(out, meta)
+	}
+	if len(out) >= len(data) {
+		return false, nil
+	}
+	return true, replaceFile(filePath, out)
+}
+
+// replaceFile writes data to a temporary file next to filePath and renames it
+// over filePath.
+func replaceFile(filePath string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".compress-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func hasImageMagick() bool {
+	_, err := exec.LookPath("convert")
+	return err == nil
+}
+
+// compressImageMagick runs identify and convert, the arguments are passed
+// without a shell so any file name is safe. The metadata of an allowlist is
+// injected again after convert stripped it, other formats than JPEG and PNG
+// keep their metadata.
+func compressImageMagick(quality int, filePath string) (bool, error) {
+	out, err := exec.Command("identify", "-format", "%Q|%m", filePath+"[0]").Output()
+	if err != nil {
+		return false, fmt.Errorf("identify: %w", err)
+	}
+
+	fields := bytes.SplitN(bytes.TrimSpace(out), []byte("|"), 2)
+	qualityNum, _ := strconv.Atoi(string(fields[0]))
+	if quality >= qualityNum {
+		return false, nil
+	}
+
+	interlace := "PNG"
+	if len(fields) == 2 && string(fields[1]) == "JPEG" {
+		interlace = "JPEG"
+	}
+	format := ""
+	if len(fields) == 2 && (string(fields[1]) == "JPEG" || string(fields[1]) == "PNG") {
+		format = string(fields[1])
+	}
+
+	policy, tags := metadataPolicy()
+	var meta imageMeta
+	if policy == metadataAllowlist && format != "" {
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return false, err
+		}
+		meta = readImageMeta(data).filter(policy, tags)
+	}
+
+	args := []string{filePath, "-sampling-factor", "4:2:0"}
+	if policy == metadataStrip || (policy == metadataAllowlist && format != "") {
+		args = append(args, "-strip")
+	}
+	args = append(args,
+		"-quality", strconv.Itoa(quality),
+		"-interlace", interlace,
+		"-colorspace", "sRGB",
+		filePath)
+	if err := run(exec.Command("convert", args...)); err != nil {
+		return false, err
+	}
+	if meta.empty() {
+		return true, nil
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return false, err
+	}
+	if format == "JPEG" {
+		data = injectJPEG(data, meta)
+	} else {
+		data = injectPNG(data, meta)
+	}
+	return true, replaceFile(filePath, data)
+}
@@ -0,0 +1,205 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// converter runs the external encoder and decoder of an image format. The
+// encoder writes the metadata m, the decoder writes PNG.
+type converter struct {
+	ext    string
+	encode func(quality int, src, dst string, m imageMeta) error
+	decode func(src, dst string) *exec.Cmd
+}
+
+// converters are the formats an image backup can be stored as.
+var converters = map[string]converter{
+	"webp": {
+		ext: ".webp",
+		encode: func(quality int, src, dst string, m imageMeta) error {
+			if err := run(exec.Command("cwebp", "-quiet", "-metadata", "none", "-q", strconv.Itoa(quality), src, "-o", dst)); err != nil {
+				return err
+			}
+			if m.empty() {
+				return nil
+			}
+			data, err := os.ReadFile(dst)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(dst, injectWebP(data, m), 0600)
+		},
+		decode: func(src, dst string) *exec.Cmd {
+			return exec.Command("dwebp", "-quiet", src, "-png", "-o", dst)
+		},
+	},
+	"avif": {
+		ext: ".avif",
+		encode: func(quality int, src, dst string, m imageMeta) error {
+			args := []string{"-q", strconv.Itoa(quality), "--ignore-exif", "--ignore-xmp", "--ignore-icc"}
+			for _, f := range []struct {
+				flag string
+				data []byte
+			}{{"--exif", m.exif}, {"--xmp", m.xmp}, {"--icc", m.icc}} {
+				if len(f.data) == 0 {
+					continue
+				}
+				name, cleanup, err := tempPath(".bin")
+				if err != nil {
+					return err
+				}
+				defer cleanup()
+				if err := os.WriteFile(name, f.data, 0600); err != nil {
+					return err
+				}
+				args = append(args, f.flag, name)
+			}
+			return run(exec.Command("avifenc", append(args, src, dst)...))
+		},
+		decode: func(src, dst string) *exec.Cmd {
+			return exec.Command("avifdec", src, dst)
+		},
+	},
+}
+
+// ConvertExt returns the file extension of a converted format, empty for an
+// unknown format.
+func ConvertExt(format string) string {
+	return converters[format].ext
+}
+
+// imageFormat returns the format of the JPEG or PNG at filePath.
+func imageFormat(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return "", errUnsupported
+	}
+	if format != "jpeg" && format != "png" {
+		return "", errUnsupported
+	}
+	return format, nil
+}
+
+// convert encodes the image at filePath as format into a temporary file, the
+// metadata policy is applied. The returned function removes it.
+func (c *builder) convert(filePath, format string, quality int) (string, func(), error) {
+	conv, ok := converters[format]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown image format %q", format)
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", nil, err
+	}
+	policy, tags := metadataPolicy()
+	meta := readImageMeta(data).filter(policy, tags)
+
+	dst, cleanup, err := tempPath(conv.ext)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := conv.encode(quality, filePath, dst, meta); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dst, cleanup, nil
+}
+
+// Reencode decodes an image stored as format and writes it to w in its
+// original format with the stored metadata, a JPEG is encoded with quality.
+func Reencode(w io.Writer, r io.Reader, format, originalFormat string, quality int) error {
+	if quality <= 0 {
+		quality = jpeg.DefaultQuality
+	}
+	conv, ok := converters[format]
+	if !ok {
+		return fmt.Errorf("unknown image format %q", format)
+	}
+
+	src, cleanupSrc, err := tempPath(conv.ext)
+	if err != nil {
+		return err
+	}
+	defer cleanupSrc()
+	stored, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(src, stored, 0600); err != nil {
+		return err
+	}
+
+	dst, cleanupDst, err := tempPath(".png")
+	if err != nil {
+		return err
+	}
+	defer cleanupDst()
+	if err := run(conv.decode(src, dst)); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(dst)
+	if err != nil {
+		return err
+	}
+	// the metadata of the stored image, avifdec writes it to the PNG itself
+	meta := readImageMeta(stored)
+	if meta.empty() {
+		meta = readImageMeta(data)
+	}
+	switch originalFormat {
+	case "png":
+		if meta.rawFormat != "png" {
+			data = injectPNG(data, meta)
+		}
+		_, err = w.Write(data)
+		return err
+	case "jpeg":
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return err
+		}
+		_, err = w.Write(injectJPEG(buf.Bytes(), meta))
+		return err
+	default:
+		return fmt.Errorf("unknown original format %q", originalFormat)
+	}
+}
+
+// tempPath returns the path of a new empty temporary file with ext.
+func tempPath(ext string) (string, func(), error) {
+	f, err := os.CreateTemp("", "watchgo-*"+ext)
+	if err != nil {
+		return "", nil, err
+	}
+	_ = f.Close()
+	return f.Name(), func() { _ = os.Remove(f.Name()) }, nil
+}
+
+// run runs cmd and adds its output to the error.
+func run(cmd *exec.Cmd) error {
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", filepath.Base(cmd.Path), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
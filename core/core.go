@@ -1,22 +1,26 @@
 package core
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path"
-	"strconv"
+	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/hinha/watchgo/config"
 	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/storage"
 )
 
-type builder struct{}
+type builder struct {
+	store storage.Storage
+}
 
-func (c *builder) createFolder(subPath []string) string {
+// folder returns the name of the backup folder a file of subPath belongs to.
+func (c *builder) folder(subPath []string) string {
 	dstFolder, subFolder := subPath[0], subPath[1]
 	if strings.HasPrefix(subFolder, "/") {
 		// remove trailing slash
@@ -35,81 +39,85 @@ func (c *builder) createFolder(subPath []string) string {
 		subFolder = ""
 	}
 
-	originPath := path.Join(config.FileSystemCfg.Backup.HardDrivePath, config.GetStaticBackupFolder(), dstFolder, subFolder)
-	if err := os.MkdirAll(originPath, os.ModePerm); err != nil {
-		logger.Error().Str("path", originPath).Err(os.ErrPermission).Msg("creating folder")
-		return ""
+	return path.Join(dstFolder, subFolder)
+}
+
+// checksum returns the SHA-1 sum of filePath, it is stored as metadata of the
+// backup so a sync can match a source file without reading the backup.
+func (c *builder) checksum(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
 	}
+	defer f.Close()
 
-	return originPath
+	hash := sha1.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func (c *builder) copy(srcPath, dstPath string) {
+func (c *builder) copy(srcPath, dstName string, meta storage.Metadata) error {
 	duration := time.Now()
-	sourceFileStat, _ := os.Stat(srcPath)
+	sourceFileStat, err := os.Stat(srcPath)
+	if err != nil {
+		logger.Error().Str("path", srcPath).Err(err).Msg("stat")
+		return err
+	}
 	if !sourceFileStat.Mode().IsRegular() {
-		logger.Error().Str("path", srcPath).Err(fmt.Errorf("not a regular file")).Msg("stat")
-		return
+		err := fmt.Errorf("not a regular file")
+		logger.Error().Str("path", srcPath).Err(err).Msg("stat")
+		return err
 	}
 
 	source, err := os.Open(srcPath)
 	if err != nil {
 		logger.Error().Str("path", srcPath).Err(err).Msg("source open file")
-		return
+		return err
 	}
 	defer source.Close()
 
-	destination, err := os.Create(dstPath)
-	if err != nil {
-		logger.Error().Str("path", srcPath).Err(err).Msg("destination create file")
-		return
+	if err := c.store.Put(dstName, source, meta); err != nil {
+		logger.Error().Str("path", srcPath).Str("storage", c.store.String()).Err(err).Msg("destination create file")
+		return err
 	}
-	defer destination.Close()
 
-	_, _ = io.Copy(destination, source)
 	logger.Info(time.Since(duration)).
 		Str("path", srcPath).
-		Str("dstPath", dstPath).
+		Str("dstPath", dstName).
+		Str("storage", c.store.String()).
 		Msg("copy file was successfully")
+	return nil
 }
 
-func (c *builder) compress(quality int, filePath, interlace string) {
-	duration := time.Now()
-	fi, err := os.Stat(filePath)
+// stage copies srcPath into a temporary file which can be modified before it
+// is stored. The returned function removes the temporary file.
+func (c *builder) stage(srcPath string) (string, func(), error) {
+	source, err := os.Open(srcPath)
 	if err != nil {
-		logger.Error().Str("path", filePath).Err(err).Msg("load file")
-		return
+		return "", nil, err
 	}
-	beforeSize := fi.Size()
+	defer source.Close()
 
-	cmd := fmt.Sprintf("identify -format %s '%s'", "'%Q'", filePath)
-	out, err := exec.Command("bash", "-c", cmd).Output()
+	tmp, err := os.CreateTemp("", "watchgo-*"+filepath.Ext(srcPath))
 	if err != nil {
-		logger.Error().Str("path", filePath).Err(err).Msg("incorrect file name")
-		return
+		return "", nil, err
 	}
+	cleanup := func() { _ = os.Remove(tmp.Name()) }
 
-	qualityNum, _ := strconv.ParseInt(string(out), 10, 0)
-	if int64(quality) >= qualityNum {
-		logger.Info(time.Since(duration)).Str("path", filePath).Msg("file already compressed")
-		return
+	if _, err := io.Copy(tmp, source); err != nil {
+		_ = tmp.Close()
+		cleanup()
+		return "", nil, err
 	}
-
-	cmd = fmt.Sprintf("convert '%s' -sampling-factor 4:2:0 -strip -quality %d -interlace %s -colorspace sRGB '%s'",
-		filePath,
-		quality,
-		interlace,
-		filePath)
-
-	if _, err := exec.Command("bash", "-c", cmd).Output(); err != nil {
-		logger.Error().Str("path", filePath).Err(err).Msg("compress image")
+	if err := tmp.Close(); err != nil {
+		cleanup()
+		return "", nil, err
 	}
-
-	fl, _ := os.Stat(filePath)
-	afterSize := fl.Size()
-	logger.Info(time.Since(duration)).Str("path", filePath).Msg(fmt.Sprintf("compress file is done, filesize before %d, after %d", beforeSize, afterSize))
+	return tmp.Name(), cleanup, nil
 }
 
-func NewBuilder() Builder {
-	return &builder{}
+func NewBuilder(store storage.Storage) Builder {
+	return &builder{store: store}
 }
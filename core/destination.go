@@ -0,0 +1,234 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/index"
+	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/storage"
+)
+
+var (
+	// retryInterval backoff of a failing destination, it grows with every
+	// consecutive failure up to maxRetryInterval.
+	retryInterval    = time.Minute
+	maxRetryInterval = 30 * time.Minute
+)
+
+// Destination is a backup target with its own prefix filters, compression
+// toggle and failure state. A failing destination is skipped until its
+// backoff expired, the periodic sync catches up on the files it missed.
+type Destination struct {
+	Name  string
+	cfg   config.DestinationConfig
+	index *index.Index
+
+	mu       sync.Mutex
+	store    storage.Storage
+	builder  Builder
+	handlers map[string]Handler
+	file     *File
+	failures int
+	lastErr  error
+	retryAt  time.Time
+}
+
+// NewDestinations returns every destination of the backup section, the
+// backups are recorded in idx. A destination which can not be opened yet is
+// retried on its next use.
+func NewDestinations(cfg config.BackupConfig, idx *index.Index) []*Destination {
+	var dests []*Destination
+	for i, dc := range cfg.DestinationList() {
+		name := dc.Name
+		if name == "" {
+			name = fmt.Sprintf("%d-%s", i, dc.Type)
+			if dc.Type == "" {
+				name = fmt.Sprintf("%d-local", i)
+			}
+		}
+
+		d := &Destination{Name: name, cfg: dc, index: idx}
+		if _, err := d.Storage(); err != nil {
+			logger.Error().Str("destination", d.Name).Err(err).Msg("open backup destination")
+		}
+		dests = append(dests, d)
+	}
+	return dests
+}
+
+// Storage returns the storage of the destination, opening it when needed.
+func (d *Destination) Storage() (storage.Storage, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.store != nil {
+		return d.store, nil
+	}
+
+	store, err := storage.New(d.cfg)
+	if err != nil {
+		d.fail(err)
+		return nil, err
+	}
+
+	builder := NewBuilder(store)
+	d.store = store
+	d.builder = builder
+	d.handlers = newHandlers(builder)
+	d.file = NewFileReader(builder)
+	return store, nil
+}
+
+// Available reports whether the destination is healthy or its backoff expired.
+func (d *Destination) Available() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.failures == 0 || time.Now().After(d.retryAt)
+}
+
+// Status returns the consecutive failures and the last error.
+func (d *Destination) Status() (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.failures, d.lastErr
+}
+
+// Match reports whether the file name of lPath starts with one of the prefix
+// filters of the destination.
+func (d *Destination) Match(lPath string) bool {
+	if len(d.cfg.Prefix) == 0 {
+		return true
+	}
+
+	base := filepath.Base(lPath)
+	for _, prefix := range d.cfg.Prefix {
+		if prefix == "*" || strings.HasPrefix(base, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Destination) compress() bool {
+	if d.cfg.Compress != nil {
+		return *d.cfg.Compress
+	}
+	return config.FileSystemCfg.Compress.Enabled
+}
+
+// Backup stores lPath in the destination and updates its failure state.
+func (d *Destination) Backup(lPath string, subPath []string) error {
+	if _, err := d.Storage(); err != nil {
+		return err
+	}
+
+	// without compression every format is stored as file
+	var h Handler = d.file
+	if d.compress() {
+		handler, err := handlerFor(d.handlers, lPath)
+		if err != nil {
+			return err
+		}
+		if handler != nil {
+			h = handler
+		}
+	}
+	// only the video handler stores a file exceeding max_file_size
+	if _, video := h.(*Video); !video {
+		if fi, err := os.Stat(lPath); err == nil && Transcodable(lPath, fi.Size()) {
+			if err := oversized(fi.Size()); err != nil {
+				return err
+			}
+		}
+	}
+
+	err := h.Open(lPath, subPath)
+	if errors.Is(err, errSizeLimit) {
+		// the file is rejected, the destination does not fail
+		return err
+	}
+	if err == nil {
+		name := path.Join(d.builder.folder(subPath), filepath.Base(lPath))
+		if err := d.index.PutBackup(lPath, d.Name, name, time.Now()); err != nil {
+			logger.Error().Str("destination", d.Name).Str("path", lPath).Err(err).Msg("index backup")
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		d.fail(err)
+		return err
+	}
+	if d.failures > 0 {
+		logger.Info(0).Str("destination", d.Name).Int("failures", d.failures).Msg("backup destination recovered")
+	}
+	d.failures, d.lastErr = 0, nil
+	return nil
+}
+
+// Thumbnailable reports whether the destination keeps a thumbnail of lPath,
+// thumbnails are written by the image handler.
+func (d *Destination) Thumbnailable(lPath string) bool {
+	return config.FileSystemCfg.Thumbnails.Enabled && d.compress() && handlerName(lPath) == handlerImage
+}
+
+// Thumbnail stores the missing thumbnail of lPath which is backed up as name
+// with the source sum.
+func (d *Destination) Thumbnail(lPath, name, sum string) error {
+	if _, err := d.Storage(); err != nil {
+		return err
+	}
+	return thumbnail(d.builder, lPath, storage.ThumbName(name), sum)
+}
+
+// fail records a failure, d.mu must be held.
+func (d *Destination) fail(err error) {
+	d.failures++
+	d.lastErr = err
+
+	backoff := time.Duration(d.failures) * retryInterval
+	if backoff > maxRetryInterval {
+		backoff = maxRetryInterval
+	}
+	d.retryAt = time.Now().Add(backoff)
+}
+
+// Backup fans lPath out to every matching destination. The destinations run
+// concurrently, so a slow or failing one does not hold back the others.
+func Backup(dests []*Destination, lPath string, subPath []string) {
+	var wg sync.WaitGroup
+	for _, d := range dests {
+		if !d.Match(lPath) {
+			continue
+		}
+		if !d.Available() {
+			logger.Debug().Str("destination", d.Name).Str("path", lPath).Msg("skip failing backup destination")
+			continue
+		}
+
+		wg.Add(1)
+		go func(d *Destination) {
+			defer wg.Done()
+
+			if err := d.Backup(lPath, subPath); err != nil {
+				failures, _ := d.Status()
+				logger.Error().
+					Str("destination", d.Name).
+					Str("path", lPath).
+					Int("failures", failures).
+					Err(err).
+					Msg("backup destination failed")
+			}
+		}(d)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,220 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// exifTags are the names of the EXIF tags an allowlist can keep, "GPS" keeps
+// the whole GPS directory.
+var exifTags = map[string]uint16{
+	"ImageDescription":    0x010E,
+	"Make":                0x010F,
+	"Model":               0x0110,
+	"Orientation":         0x0112,
+	"XResolution":         0x011A,
+	"YResolution":         0x011B,
+	"ResolutionUnit":      0x0128,
+	"Software":            0x0131,
+	"DateTime":            0x0132,
+	"Artist":              0x013B,
+	"Copyright":           0x8298,
+	"ExposureTime":        0x829A,
+	"FNumber":             0x829D,
+	"ISOSpeedRatings":     0x8827,
+	"DateTimeOriginal":    0x9003,
+	"DateTimeDigitized":   0x9004,
+	"OffsetTime":          0x9010,
+	"OffsetTimeOriginal":  0x9011,
+	"OffsetTimeDigitized": 0x9012,
+	"FocalLength":         0x920A,
+	"UserComment":         0x9286,
+	"SubSecTimeOriginal":  0x9291,
+	"ColorSpace":          0xA001,
+	"LensModel":           0xA434,
+}
+
+const (
+	tagExifIFD = 0x8769
+	tagGPSIFD  = 0x8825
+
+	typeLong = 4
+)
+
+// typeSizes is the byte size of a TIFF field type.
+var typeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+var errExif = errors.New("invalid exif data")
+
+// byteOrder reads and appends the integers of a TIFF structure.
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// ifdEntry is a field of an image file directory, sub is the directory a
+// pointer field refers to.
+type ifdEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+	sub      []ifdEntry
+}
+
+// filterExif returns a TIFF structure holding only the tags in allow of IFD0,
+// the Exif and GPS directories. It is nil when no tag is left.
+func filterExif(tiff []byte, allow map[string]bool) ([]byte, error) {
+	if len(tiff) < 8 {
+		return nil, errExif
+	}
+	var order byteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errExif
+	}
+
+	keep := map[uint16]bool{}
+	for name, tag := range exifTags {
+		if allow[name] {
+			keep[tag] = true
+		}
+	}
+
+	r := tiffReader{data: tiff, order: order}
+	ifd0, err := r.readIFD(order.Uint32(tiff[4:]), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var filter func(entries []ifdEntry, depth int) ([]ifdEntry, error)
+	filter = func(entries []ifdEntry, depth int) ([]ifdEntry, error) {
+		var kept []ifdEntry
+		for _, e := range entries {
+			switch {
+			case e.tag == tagGPSIFD && depth == 0:
+				if !allow["GPS"] || !isPointer(e) {
+					continue
+				}
+				sub, err := r.readIFD(order.Uint32(e.value), 1)
+				if err != nil {
+					return nil, err
+				}
+				e.sub = sub
+			case e.tag == tagExifIFD && depth == 0:
+				if !isPointer(e) {
+					continue
+				}
+				sub, err := r.readIFD(order.Uint32(e.value), 1)
+				if err != nil {
+					return nil, err
+				}
+				if e.sub, err = filter(sub, 1); err != nil {
+					return nil, err
+				}
+				if len(e.sub) == 0 {
+					continue
+				}
+			case !keep[e.tag]:
+				continue
+			}
+			kept = append(kept, e)
+		}
+		return kept, nil
+	}
+
+	kept, err := filter(ifd0, 0)
+	if err != nil || len(kept) == 0 {
+		return nil, err
+	}
+
+	w := tiffWriter{order: order, buf: append([]byte{}, tiff[:4]...)}
+	w.buf = order.AppendUint32(w.buf, 8)
+	w.writeIFD(kept)
+	return w.buf, nil
+}
+
+// isPointer reports whether the directory pointer e is a single LONG, a
+// malformed pointer is dropped.
+func isPointer(e ifdEntry) bool {
+	return e.typ == typeLong && e.count == 1 && len(e.value) >= 4
+}
+
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// readIFD reads the directory at off, the values of its fields are copied.
+func (r *tiffReader) readIFD(off uint32, depth int) ([]ifdEntry, error) {
+	if depth > 1 || uint64(off)+2 > uint64(len(r.data)) {
+		return nil, errExif
+	}
+	n := uint32(r.order.Uint16(r.data[off:]))
+	if uint64(off)+2+uint64(n)*12 > uint64(len(r.data)) {
+		return nil, errExif
+	}
+
+	entries := make([]ifdEntry, 0, n)
+	for i := uint32(0); i < n; i++ {
+		p := r.data[off+2+i*12:]
+		e := ifdEntry{tag: r.order.Uint16(p), typ: r.order.Uint16(p[2:]), count: r.order.Uint32(p[4:])}
+		size, ok := typeSizes[e.typ]
+		if !ok {
+			continue
+		}
+		length := uint64(size) * uint64(e.count)
+		if length <= 4 {
+			e.value = append([]byte{}, p[8:8+length]...)
+		} else {
+			vOff := uint64(r.order.Uint32(p[8:]))
+			if vOff+length > uint64(len(r.data)) {
+				continue
+			}
+			e.value = append([]byte{}, r.data[vOff:vOff+length]...)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+type tiffWriter struct {
+	order byteOrder
+	buf   []byte
+}
+
+// writeIFD appends a directory and the values of its fields, it returns the
+// offset of the directory.
+func (w *tiffWriter) writeIFD(entries []ifdEntry) uint32 {
+	off := uint32(len(w.buf))
+	w.buf = w.order.AppendUint16(w.buf, uint16(len(entries)))
+	w.buf = append(w.buf, make([]byte, len(entries)*12+4)...)
+
+	for i, e := range entries {
+		value := e.value
+		if e.sub != nil {
+			value = w.order.AppendUint32(nil, w.writeIFD(e.sub))
+		}
+
+		var field [4]byte
+		if len(value) <= 4 {
+			copy(field[:], value)
+		} else {
+			w.order.PutUint32(field[:], uint32(len(w.buf)))
+			w.buf = append(w.buf, value...)
+			if len(w.buf)%2 == 1 {
+				w.buf = append(w.buf, 0)
+			}
+		}
+
+		p := w.buf[off+2+uint32(i)*12:]
+		w.order.PutUint16(p, e.tag)
+		w.order.PutUint16(p[2:], e.typ)
+		w.order.PutUint32(p[4:], e.count)
+		copy(p[8:], field[:])
+	}
+	return off
+}
@@ -0,0 +1,189 @@
+package core
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// testEntry is a field of a TIFF directory built by buildTIFF, value holds at
+// most 4 bytes.
+type testEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+// buildTIFF returns a little endian TIFF structure with IFD0 at offset 8 and
+// the directories of subs following it, a pointer field refers to the
+// directory of its index with value nil.
+func buildTIFF(ifd0 []testEntry, subs ...[]testEntry) []byte {
+	le := binary.LittleEndian
+	size := func(entries []testEntry) int { return 2 + 12*len(entries) + 4 }
+
+	offsets := []int{8}
+	off := 8 + size(ifd0)
+	for _, sub := range subs {
+		offsets = append(offsets, off)
+		off += size(sub)
+	}
+
+	buf := []byte("II*\x00\x08\x00\x00\x00")
+	sub := 1
+	for _, entries := range append([][]testEntry{ifd0}, subs...) {
+		buf = le.AppendUint16(buf, uint16(len(entries)))
+		for _, e := range entries {
+			buf = le.AppendUint16(buf, e.tag)
+			buf = le.AppendUint16(buf, e.typ)
+			buf = le.AppendUint32(buf, e.count)
+			var field [4]byte
+			if e.value == nil {
+				le.PutUint32(field[:], uint32(offsets[sub]))
+				sub++
+			} else {
+				copy(field[:], e.value)
+			}
+			buf = append(buf, field[:]...)
+		}
+		buf = le.AppendUint32(buf, 0)
+	}
+	return buf
+}
+
+func short(v uint16) []byte {
+	return binary.LittleEndian.AppendUint16(nil, v)
+}
+
+func TestFilterExif(t *testing.T) {
+	orientation := testEntry{tag: 0x0112, typ: 3, count: 1, value: short(6)}
+	make_ := testEntry{tag: 0x010F, typ: 2, count: 4, value: []byte("Cam\x00")}
+	original := testEntry{tag: 0x9003, typ: 2, count: 4, value: []byte("2023")}
+	gps := []testEntry{{tag: 0x0001, typ: 2, count: 2, value: []byte("N\x00")}}
+
+	tests := []struct {
+		name  string
+		tiff  []byte
+		allow []string
+		tags  []uint16
+		err   bool
+	}{
+		{
+			name:  "keeps allowed tags",
+			tiff:  buildTIFF([]testEntry{make_, orientation, {tag: tagExifIFD, typ: typeLong, count: 1}}, []testEntry{original}),
+			allow: []string{"Orientation", "DateTimeOriginal"},
+			tags:  []uint16{0x0112, tagExifIFD},
+		},
+		{
+			name:  "drops exif directory without allowed tags",
+			tiff:  buildTIFF([]testEntry{orientation, {tag: tagExifIFD, typ: typeLong, count: 1}}, []testEntry{original}),
+			allow: []string{"Orientation"},
+			tags:  []uint16{0x0112},
+		},
+		{
+			name:  "keeps gps directory",
+			tiff:  buildTIFF([]testEntry{{tag: tagGPSIFD, typ: typeLong, count: 1}}, gps),
+			allow: []string{"GPS"},
+			tags:  []uint16{tagGPSIFD},
+		},
+		{
+			name:  "nothing allowed",
+			tiff:  buildTIFF([]testEntry{make_}),
+			allow: []string{"Orientation"},
+		},
+		{
+			name:  "exif pointer of type short",
+			tiff:  buildTIFF([]testEntry{orientation, {tag: tagExifIFD, typ: 3, count: 1, value: short(8)}}),
+			allow: []string{"Orientation", "DateTimeOriginal"},
+			tags:  []uint16{0x0112},
+		},
+		{
+			name:  "exif pointer without value",
+			tiff:  buildTIFF([]testEntry{orientation, {tag: tagExifIFD, typ: typeLong, count: 0, value: []byte{}}}),
+			allow: []string{"Orientation"},
+			tags:  []uint16{0x0112},
+		},
+		{
+			name:  "gps pointer of type byte",
+			tiff:  buildTIFF([]testEntry{orientation, {tag: tagGPSIFD, typ: 1, count: 1, value: []byte{8}}}),
+			allow: []string{"Orientation", "GPS"},
+			tags:  []uint16{0x0112},
+		},
+		{
+			name:  "exif pointer outside the data",
+			tiff:  buildTIFF([]testEntry{{tag: tagExifIFD, typ: typeLong, count: 1, value: []byte{0xFF, 0xFF, 0, 0}}}),
+			allow: []string{"DateTimeOriginal"},
+			err:   true,
+		},
+		{
+			name: "ifd0 outside the data",
+			tiff: []byte("II*\x00\xFF\x00\x00\x00"),
+			err:  true,
+		},
+		{
+			name: "entry count beyond the data",
+			tiff: []byte("II*\x00\x08\x00\x00\x00\x09\x00"),
+			err:  true,
+		},
+		{
+			name: "unknown byte order",
+			tiff: []byte("XX*\x00\x08\x00\x00\x00\x00\x00"),
+			err:  true,
+		},
+		{
+			name: "truncated header",
+			tiff: []byte("II*"),
+			err:  true,
+		},
+		{
+			name:  "value offset outside the data",
+			tiff:  buildTIFF([]testEntry{orientation, {tag: 0x010F, typ: 2, count: 64, value: []byte{0xFF, 0xFF, 0, 0}}}),
+			allow: []string{"Orientation", "Make"},
+			tags:  []uint16{0x0112},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allow := map[string]bool{}
+			for _, tag := range tt.allow {
+				allow[tag] = true
+			}
+			out, err := filterExif(tt.tiff, allow)
+			if (err != nil) != tt.err {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+			if len(tt.tags) == 0 {
+				if out != nil {
+					t.Fatalf("out = %x, want nil", out)
+				}
+				return
+			}
+
+			r := tiffReader{data: out, order: binary.LittleEndian}
+			entries, err := r.readIFD(binary.LittleEndian.Uint32(out[4:]), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(tt.tags) {
+				t.Fatalf("got %d tags, want %d", len(entries), len(tt.tags))
+			}
+			for i, e := range entries {
+				if e.tag != tt.tags[i] {
+					t.Errorf("tag %d = %#x, want %#x", i, e.tag, tt.tags[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFilterExifTruncated(t *testing.T) {
+	tiff := buildTIFF([]testEntry{
+		{tag: 0x0112, typ: 3, count: 1, value: short(6)},
+		{tag: tagExifIFD, typ: typeLong, count: 1},
+		{tag: tagGPSIFD, typ: typeLong, count: 1},
+	}, []testEntry{{tag: 0x9003, typ: 2, count: 4, value: []byte("2023")}}, []testEntry{{tag: 0x0001, typ: 2, count: 2, value: []byte("N\x00")}})
+
+	allow := map[string]bool{"Orientation": true, "DateTimeOriginal": true, "GPS": true}
+	for n := 0; n < len(tiff); n++ {
+		_, _ = filterExif(tiff[:n], allow)
+	}
+}
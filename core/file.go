@@ -1,12 +1,21 @@
 package core
 
 import (
-	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/storage"
 )
 
+// skipExtensions are formats which are already compressed.
+var skipExtensions = []string{
+	"7z", "avif", "br", "bz2", "docx", "gif", "gz", "heic", "jpeg", "jpg", "lz4", "mkv",
+	"mov", "mp3", "mp4", "odt", "png", "rar", "webm", "webp", "xlsx", "xz", "zip", "zst",
+}
+
 func NewFileReader(builder Builder) *File {
 	return &File{builder: builder}
 }
@@ -16,19 +25,58 @@ type File struct {
 }
 
 func (i *File) Open(lPath string, subPath []string) error {
-	folder := i.builder.createFolder(subPath)
-	if folder == "" {
-		return fmt.Errorf("error creating folder")
-	}
+	_, _, err := i.put(lPath, subPath)
+	return err
+}
 
+// put stores lPath and returns its backup name and sum.
+func (i *File) put(lPath string, subPath []string) (string, string, error) {
 	fi, err := os.Stat(lPath)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
 	lPath = filepath.Clean(lPath)
-	dstPath := filepath.Clean(path.Join(folder, fi.Name()))
-	i.builder.copy(lPath, dstPath)
+	dstName := path.Join(i.builder.folder(subPath), fi.Name())
+	sum, err := i.builder.checksum(lPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	meta := storage.Metadata{storage.MetaSum: sum}
+	if codec := fileCodec(fi); codec != "" {
+		meta[storage.MetaCodec] = codec
+	}
+	return dstName, sum, i.builder.copy(lPath, dstName, meta)
+}
+
+// fileCodec returns the codec fi is compressed with, empty when it is stored
+// as is.
+func fileCodec(fi os.FileInfo) string {
+	cfg := config.FileSystemCfg.Compress.Files
+	if !cfg.Enabled {
+		return ""
+	}
+
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(fi.Name()), "."))
+	if codec, ok := cfg.Extensions[ext]; ok {
+		return codec
+	}
 
-	return nil
+	skip := cfg.SkipExtensions
+	if skip == nil {
+		skip = skipExtensions
+	}
+	for _, s := range skip {
+		if strings.EqualFold(strings.TrimPrefix(s, "."), ext) {
+			return ""
+		}
+	}
+	if fi.Size() < cfg.MinSize*1024 {
+		return ""
+	}
+	if cfg.Codec == "" {
+		return "zstd"
+	}
+	return cfg.Codec
 }
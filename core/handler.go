@@ -0,0 +1,105 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/hinha/watchgo/config"
+)
+
+// Handler backs up a file of the formats it is registered for.
+type Handler interface {
+	Open(lPath string, subPath []string) error
+}
+
+// HandlerFactory returns the handler of a destination writing with builder.
+type HandlerFactory func(builder Builder) Handler
+
+// handler names of the built in handlers.
+const (
+	handlerImage    = "image"
+	handlerOriginal = "original"
+	handlerPDF      = "pdf"
+	handlerVideo    = "video"
+	handlerFile     = "file"
+)
+
+var (
+	registryMu sync.RWMutex
+	// handlers by name and the handler name of every format, a format is the
+	// lower case file extension without dot.
+	handlers = map[string]HandlerFactory{}
+	formats  = map[string]string{}
+)
+
+func init() {
+	RegisterHandler(handlerImage, func(builder Builder) Handler { return NewImageReader(builder) })
+	RegisterHandler(handlerOriginal, func(builder Builder) Handler { return NewOriginalReader(builder) })
+	RegisterHandler(handlerPDF, func(builder Builder) Handler { return NewPDFReader(builder) })
+	RegisterHandler(handlerVideo, func(builder Builder) Handler { return NewVideoReader(builder) })
+	RegisterHandler(handlerFile, func(builder Builder) Handler { return NewFileReader(builder) })
+
+	RegisterFormat(handlerImage, "jpg", "jpeg", "png")
+	RegisterFormat(handlerPDF, "pdf")
+	RegisterFormat(handlerVideo,
+		"mp4", "m4v", "mov", "mkv", "webm", "avi", "wmv", "flv", "mpeg", "mpg", "mts", "3gp")
+	RegisterFormat(handlerOriginal,
+		"tif", "tiff", "heic", "heif", "psd",
+		"raw", "cr2", "cr3", "nef", "nrw", "arw", "srf", "sr2", "dng", "orf", "rw2", "raf", "pef", "srw", "x3f")
+}
+
+// RegisterHandler adds or replaces the handler name.
+func RegisterHandler(name string, factory HandlerFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	handlers[name] = factory
+}
+
+// RegisterFormat routes the formats to the handler name.
+func RegisterFormat(name string, exts ...string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, format := range exts {
+		formats[strings.ToLower(strings.TrimPrefix(format, "."))] = name
+	}
+}
+
+// newHandlers returns an instance of every registered handler for builder.
+func newHandlers(builder Builder) map[string]Handler {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	hs := make(map[string]Handler, len(handlers))
+	for name, factory := range handlers {
+		hs[name] = factory(builder)
+	}
+	return hs
+}
+
+// handlerName returns the handler of the format of lPath, compress.handlers
+// of the configuration overrides the registered formats. It is empty for an
+// unknown format.
+func handlerName(lPath string) string {
+	format := strings.ToLower(strings.TrimPrefix(filepath.Ext(lPath), "."))
+	if name, ok := config.FileSystemCfg.Compress.Handlers[format]; ok {
+		return name
+	}
+
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return formats[format]
+}
+
+// handlerFor returns the handler of lPath from hs, nil for an unknown format.
+func handlerFor(hs map[string]Handler, lPath string) (Handler, error) {
+	name := handlerName(lPath)
+	if name == "" {
+		return nil, nil
+	}
+	h, ok := hs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown handler %q", name)
+	}
+	return h, nil
+}
@@ -1,17 +1,14 @@
 package core
 
 import (
-	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"time"
 
 	"github.com/hinha/watchgo/config"
-)
-
-var (
-	cmdJPG = "JPEG"
-	cmdPNG = "PNG"
+	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/storage"
 )
 
 func NewImageReader(builder Builder) *Image {
@@ -23,24 +20,114 @@ type Image struct {
 }
 
 func (i *Image) Open(lPath string, subPath []string) error {
-	folder := i.builder.createFolder(subPath)
-	if folder == "" {
-		return fmt.Errorf("error creating folder")
+	dstName, sum, err := i.put(lPath, subPath)
+	if err != nil || !config.FileSystemCfg.Thumbnails.Enabled {
+		return err
+	}
+
+	// the image is stored, a failing thumbnail does not fail the backup
+	if err := thumbnail(i.builder, lPath, storage.ThumbName(dstName), sum); err != nil {
+		logger.Error().Str("path", lPath).Err(err).Msg("image thumbnail")
+	}
+	return nil
+}
+
+// put stores lPath compressed and returns its backup name and sum.
+func (i *Image) put(lPath string, subPath []string) (string, string, error) {
+	fi, err := os.Stat(lPath)
+	if err != nil {
+		return "", "", err
 	}
-	fi, _ := os.Stat(lPath)
 
 	lPath = filepath.Clean(lPath)
-	dstPath := filepath.Clean(path.Join(folder, fi.Name()))
-	i.builder.copy(lPath, dstPath)
+	dstName := path.Join(i.builder.folder(subPath), fi.Name())
+	sum, err := i.builder.checksum(lPath)
+	if err != nil {
+		return "", "", err
+	}
+	meta := storage.Metadata{storage.MetaSum: sum}
 
-	interlace := cmdPNG
-	if IsJpg.MatchString(lPath) {
-		interlace = cmdJPG
+	cfg := config.FileSystemCfg.Compress
+	if cfg.KeepOriginal {
+		if err := i.builder.copy(lPath, dstName, meta); err != nil {
+			return "", "", err
+		}
+		return dstName, sum, i.preview(lPath, storage.PreviewName(dstName), fi.Size(), sum)
 	}
 
-	if config.FileSystemCfg.Compress.Enabled {
-		i.builder.compress(config.FileSystemCfg.Compress.Quality, dstPath, interlace)
+	// compress a staged copy, the source file is never modified
+	tmpPath, cleanup, err := i.builder.stage(lPath)
+	if err != nil {
+		return "", "", err
 	}
+	defer cleanup()
 
-	return nil
+	if cfg.Convert.Format != "" {
+		if convPath, cleanupConv, ok := i.convert(tmpPath, cfg.Convert, meta); ok {
+			defer cleanupConv()
+			return dstName, sum, i.builder.copy(convPath, dstName, meta)
+		}
+	}
+
+	i.builder.compress(cfg.Quality, tmpPath)
+	return dstName, sum, i.builder.copy(tmpPath, dstName, meta)
+}
+
+// preview stores the compressed or converted image as previewName. It is
+// skipped when compressing does not change the image.
+func (i *Image) preview(lPath, previewName string, size int64, sum string) error {
+	meta := storage.Metadata{storage.MetaSum: sum}
+
+	tmpPath, cleanup, err := i.builder.stage(lPath)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	cfg := config.FileSystemCfg.Compress
+	if cfg.Convert.Format != "" {
+		if convPath, cleanupConv, ok := i.convert(tmpPath, cfg.Convert, meta); ok {
+			defer cleanupConv()
+			return i.builder.copy(convPath, previewName, meta)
+		}
+	}
+
+	i.builder.compress(cfg.Quality, tmpPath)
+	if fi, err := os.Stat(tmpPath); err != nil || fi.Size() >= size {
+		return err
+	}
+	return i.builder.copy(tmpPath, previewName, meta)
+}
+
+// convert stores a JPEG or PNG in the configured format when the result is
+// smaller, the formats are recorded in meta. It reports false when the image
+// is kept in its own format.
+func (i *Image) convert(filePath string, cfg config.ConvertConfig, meta storage.Metadata) (string, func(), bool) {
+	duration := time.Now()
+	format, err := imageFormat(filePath)
+	if err != nil {
+		return "", nil, false
+	}
+
+	quality := cfg.Quality
+	if quality == 0 {
+		quality = config.FileSystemCfg.Compress.Quality
+	}
+	convPath, cleanup, err := i.builder.convert(filePath, cfg.Format, quality)
+	if err != nil {
+		logger.Error().Str("path", filePath).Str("format", cfg.Format).Err(err).Msg("convert image")
+		return "", nil, false
+	}
+
+	before, _ := os.Stat(filePath)
+	after, err := os.Stat(convPath)
+	if err != nil || before == nil || after.Size() >= before.Size() {
+		cleanup()
+		return "", nil, false
+	}
+
+	meta[storage.MetaFormat] = cfg.Format
+	meta[storage.MetaOriginalFormat] = format
+	logger.Info(time.Since(duration)).Str("path", filePath).Str("format", cfg.Format).Int64("before", before.Size()).Int64("after", after.Size()).Msg("convert image is done")
+	return convPath, cleanup, true
 }
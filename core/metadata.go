@@ -0,0 +1,480 @@
+package core
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/hinha/watchgo/config"
+)
+
+// metadata policies of a re-encoded image.
+const (
+	metadataKeep      = "keep"
+	metadataAllowlist = "allowlist"
+	metadataStrip     = "strip"
+)
+
+// defaultMetadataTags are kept by an allowlist without tags.
+var defaultMetadataTags = []string{"DateTimeOriginal", "Orientation", "ICC"}
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	iccHeader  = []byte("ICC_PROFILE\x00")
+	pngHeader  = []byte("\x89PNG\r\n\x1a\n")
+	xmpKeyword = "XML:com.adobe.xmp"
+)
+
+// imageMeta is the metadata of an image. exif is a TIFF structure, raw are the
+// metadata segments of a JPEG or chunks of a PNG in the format rawFormat,
+// they are copied as is when the image keeps its format and every tag.
+type imageMeta struct {
+	exif, icc, xmp []byte
+	raw            [][]byte
+	rawFormat      string
+}
+
+func (m imageMeta) empty() bool {
+	return len(m.exif) == 0 && len(m.icc) == 0 && len(m.xmp) == 0 && len(m.raw) == 0
+}
+
+// metadataPolicy returns the configured policy and the tags of an allowlist.
+func metadataPolicy() (string, []string) {
+	cfg := config.FileSystemCfg.Compress.Metadata
+	policy := cfg.Policy
+	if policy == "" {
+		policy = metadataKeep
+	}
+	tags := cfg.Tags
+	if policy == metadataAllowlist && len(tags) == 0 {
+		tags = defaultMetadataTags
+	}
+	return policy, tags
+}
+
+// filter applies the metadata policy.
+func (m imageMeta) filter(policy string, tags []string) imageMeta {
+	switch policy {
+	case metadataStrip:
+		return imageMeta{}
+	case metadataAllowlist:
+		allow := map[string]bool{}
+		for _, tag := range tags {
+			allow[tag] = true
+		}
+		exif, err := filterExif(m.exif, allow)
+		if err != nil {
+			exif = nil
+		}
+		kept := imageMeta{exif: exif}
+		if allow["ICC"] {
+			kept.icc = m.icc
+		}
+		if allow["XMP"] {
+			kept.xmp = m.xmp
+		}
+		return kept
+	default:
+		return m
+	}
+}
+
+// readImageMeta returns the metadata of a JPEG, PNG or WebP image.
+func readImageMeta(data []byte) imageMeta {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return readJPEGMeta(data)
+	case bytes.HasPrefix(data, pngHeader):
+		return readPNGMeta(data)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return readWebPMeta(data)
+	}
+	return imageMeta{}
+}
+
+func readJPEGMeta(data []byte) imageMeta {
+	m := imageMeta{rawFormat: "jpeg"}
+	icc := map[byte][]byte{}
+	for p := 2; p+4 <= len(data); {
+		if data[p] != 0xFF {
+			break
+		}
+		marker := data[p+1]
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(data[p+2:]))
+		if n < 2 || p+2+n > len(data) {
+			break
+		}
+		seg, payload := data[p:p+2+n], data[p+4:p+2+n]
+		p += 2 + n
+
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, exifHeader):
+			m.exif = payload[len(exifHeader):]
+		case marker == 0xE1 && bytes.HasPrefix(payload, xmpHeader):
+			m.xmp = payload[len(xmpHeader):]
+		case marker == 0xE2 && bytes.HasPrefix(payload, iccHeader) && len(payload) > len(iccHeader)+2:
+			icc[payload[len(iccHeader)]] = payload[len(iccHeader)+2:]
+		case marker < 0xE1 || marker > 0xEF || marker == 0xEE:
+			// APP0 is written by the encoder, APP14 Adobe describes the colour
+			// transform of the source pixels, other markers are no metadata
+			continue
+		}
+		m.raw = append(m.raw, seg)
+	}
+
+	seqs := make([]int, 0, len(icc))
+	for seq := range icc {
+		seqs = append(seqs, int(seq))
+	}
+	sort.Ints(seqs)
+	for _, seq := range seqs {
+		m.icc = append(m.icc, icc[byte(seq)]...)
+	}
+	return m
+}
+
+func readPNGMeta(data []byte) imageMeta {
+	m := imageMeta{rawFormat: "png"}
+	for p := len(pngHeader); p+12 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[p:]))
+		if n < 0 || p+12+n > len(data) {
+			break
+		}
+		typ, payload := string(data[p+4:p+8]), data[p+8:p+8+n]
+		chunk := data[p : p+12+n]
+		p += 12 + n
+
+		switch typ {
+		case "eXIf":
+			m.exif = payload
+		case "iCCP":
+			if i := bytes.IndexByte(payload, 0); i >= 0 && i+2 <= len(payload) {
+				m.icc, _ = inflate(payload[i+2:])
+			}
+		case "iTXt":
+			if bytes.HasPrefix(payload, []byte(xmpKeyword+"\x00")) {
+				m.xmp = readITXt(payload[len(xmpKeyword)+1:])
+			}
+		case "tEXt", "zTXt", "tIME":
+		default:
+			continue
+		}
+		m.raw = append(m.raw, chunk)
+	}
+	return m
+}
+
+// readITXt returns the text of an iTXt chunk after its keyword.
+func readITXt(p []byte) []byte {
+	if len(p) < 2 {
+		return nil
+	}
+	compressed := p[0] == 1
+	p = p[2:]
+	// language tag and translated keyword
+	for i := 0; i < 2; i++ {
+		j := bytes.IndexByte(p, 0)
+		if j < 0 {
+			return nil
+		}
+		p = p[j+1:]
+	}
+	if compressed {
+		text, _ := inflate(p)
+		return text
+	}
+	return p
+}
+
+func readWebPMeta(data []byte) imageMeta {
+	var m imageMeta
+	for p := 12; p+8 <= len(data); {
+		n := int(binary.LittleEndian.Uint32(data[p+4:]))
+		if n < 0 || p+8+n > len(data) {
+			break
+		}
+		typ, payload := string(data[p:p+4]), data[p+8:p+8+n]
+		p += 8 + n + n%2
+
+		switch typ {
+		case "EXIF":
+			m.exif = bytes.TrimPrefix(payload, exifHeader)
+		case "ICCP":
+			m.icc = payload
+		case "XMP ":
+			m.xmp = payload
+		}
+	}
+	return m
+}
+
+func inflate(p []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// injectJPEG inserts the metadata segments after the start of image marker
+// and a JFIF segment.
+func injectJPEG(data []byte, m imageMeta) []byte {
+	if m.empty() || !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return data
+	}
+	at := 2
+	if len(data) >= 6 && data[2] == 0xFF && data[3] == 0xE0 {
+		at += 2 + int(binary.BigEndian.Uint16(data[4:]))
+	}
+	if at > len(data) {
+		return data
+	}
+
+	// the profile has to describe the colour space of the encoded pixels
+	icc := iccFits(m.icc, jpegComponents(data))
+
+	var segs bytes.Buffer
+	if m.rawFormat == "jpeg" {
+		for _, seg := range m.raw {
+			if !icc && seg[1] == 0xE2 && bytes.HasPrefix(seg[4:], iccHeader) {
+				continue
+			}
+			segs.Write(seg)
+		}
+	} else {
+		if len(m.exif) > 0 {
+			writeSegment(&segs, 0xE1, exifHeader, m.exif)
+		}
+		if len(m.xmp) > 0 {
+			writeSegment(&segs, 0xE1, xmpHeader, m.xmp)
+		}
+		// an ICC profile is split into segments of at most 65519 bytes
+		const iccChunk = 65535 - 2 - 14
+		count := (len(m.icc) + iccChunk - 1) / iccChunk
+		if !icc {
+			count = 0
+		}
+		for i := 0; i < count; i++ {
+			end := (i + 1) * iccChunk
+			if end > len(m.icc) {
+				end = len(m.icc)
+			}
+			header := append(append([]byte{}, iccHeader...), byte(i+1), byte(count))
+			writeSegment(&segs, 0xE2, header, m.icc[i*iccChunk:end])
+		}
+	}
+
+	out := make([]byte, 0, len(data)+segs.Len())
+	out = append(out, data[:at]...)
+	out = append(out, segs.Bytes()...)
+	return append(out, data[at:]...)
+}
+
+// jpegComponents returns the number of colour components of the JPEG data, 3
+// for YCbCr and 1 for grayscale, 0 when it has no frame header.
+func jpegComponents(data []byte) int {
+	for p := 2; p+4 <= len(data); {
+		if data[p] != 0xFF {
+			return 0
+		}
+		marker := data[p+1]
+		n := int(binary.BigEndian.Uint16(data[p+2:]))
+		if marker == 0xDA || n < 2 || p+2+n > len(data) {
+			return 0
+		}
+		if marker >= 0xC0 && marker <= 0xC2 && n >= 8 {
+			return int(data[p+9])
+		}
+		p += 2 + n
+	}
+	return 0
+}
+
+// iccFits reports whether the ICC profile icc describes the colour space of
+// an image with components colour components, RGB for YCbCr and GRAY for
+// grayscale. A profile is kept when the components are unknown.
+func iccFits(icc []byte, components int) bool {
+	if len(icc) < 20 {
+		return components == 0
+	}
+	switch space := string(icc[16:20]); components {
+	case 3:
+		return space == "RGB "
+	case 1:
+		return space == "GRAY"
+	}
+	return true
+}
+
+func writeSegment(w *bytes.Buffer, marker byte, header, payload []byte) {
+	n := 2 + len(header) + len(payload)
+	if n > 0xFFFF {
+		return
+	}
+	w.Write([]byte{0xFF, marker, byte(n >> 8), byte(n)})
+	w.Write(header)
+	w.Write(payload)
+}
+
+// injectPNG inserts the metadata chunks after the IHDR chunk.
+func injectPNG(data []byte, m imageMeta) []byte {
+	const ihdrEnd = 8 + 12 + 13
+	if m.empty() || !bytes.HasPrefix(data, pngHeader) || len(data) < ihdrEnd {
+		return data
+	}
+
+	var chunks bytes.Buffer
+	if m.rawFormat == "png" {
+		for _, chunk := range m.raw {
+			chunks.Write(chunk)
+		}
+	} else {
+		if len(m.icc) > 0 {
+			var z bytes.Buffer
+			zw := zlib.NewWriter(&z)
+			_, _ = zw.Write(m.icc)
+			_ = zw.Close()
+			writeChunk(&chunks, "iCCP", append([]byte("ICC Profile\x00\x00"), z.Bytes()...))
+		}
+		if len(m.exif) > 0 {
+			writeChunk(&chunks, "eXIf", m.exif)
+		}
+		if len(m.xmp) > 0 {
+			writeChunk(&chunks, "iTXt", append([]byte(xmpKeyword+"\x00\x00\x00\x00\x00"), m.xmp...))
+		}
+	}
+
+	out := make([]byte, 0, len(data)+chunks.Len())
+	out = append(out, data[:ihdrEnd]...)
+	out = append(out, chunks.Bytes()...)
+	return append(out, data[ihdrEnd:]...)
+}
+
+func writeChunk(w *bytes.Buffer, typ string, payload []byte) {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(payload)))
+	w.Write(n[:])
+	w.WriteString(typ)
+	w.Write(payload)
+	binary.BigEndian.PutUint32(n[:], crc32.ChecksumIEEE(append([]byte(typ), payload...)))
+	w.Write(n[:])
+}
+
+// injectWebP adds the metadata chunks to a WebP image, a simple image is
+// turned into the extended format.
+func injectWebP(data []byte, m imageMeta) []byte {
+	if m.empty() || len(data) < 20 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return data
+	}
+
+	var (
+		vp8x   []byte
+		frames bytes.Buffer
+	)
+	for p := 12; p+8 <= len(data); {
+		n := int(binary.LittleEndian.Uint32(data[p+4:]))
+		end := p + 8 + n + n%2
+		if n < 0 || end > len(data) {
+			return data
+		}
+		switch typ := string(data[p : p+4]); typ {
+		case "VP8X":
+			vp8x = append([]byte{}, data[p+8:p+8+n]...)
+		case "ICCP", "EXIF", "XMP ":
+		default:
+			frames.Write(data[p:end])
+		}
+		p = end
+	}
+
+	if vp8x == nil {
+		w, h, alpha, ok := webpSize(data[12:])
+		if !ok {
+			return data
+		}
+		vp8x = make([]byte, 10)
+		if alpha {
+			vp8x[0] |= 0x10
+		}
+		putUint24(vp8x[4:], w-1)
+		putUint24(vp8x[7:], h-1)
+	}
+	vp8x[0] &^= 0x20 | 0x08 | 0x04
+	if len(m.icc) > 0 {
+		vp8x[0] |= 0x20
+	}
+	if len(m.exif) > 0 {
+		vp8x[0] |= 0x08
+	}
+	if len(m.xmp) > 0 {
+		vp8x[0] |= 0x04
+	}
+
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	writeRIFFChunk(&body, "VP8X", vp8x)
+	if len(m.icc) > 0 {
+		writeRIFFChunk(&body, "ICCP", m.icc)
+	}
+	body.Write(frames.Bytes())
+	if len(m.exif) > 0 {
+		writeRIFFChunk(&body, "EXIF", m.exif)
+	}
+	if len(m.xmp) > 0 {
+		writeRIFFChunk(&body, "XMP ", m.xmp)
+	}
+
+	out := make([]byte, 8, 8+body.Len())
+	copy(out, "RIFF")
+	binary.LittleEndian.PutUint32(out[4:], uint32(body.Len()))
+	return append(out, body.Bytes()...)
+}
+
+// webpSize returns the canvas size of a simple lossy or lossless WebP.
+func webpSize(chunk []byte) (w, h int, alpha, ok bool) {
+	if len(chunk) < 8 {
+		return 0, 0, false, false
+	}
+	p := chunk[8:]
+	switch string(chunk[:4]) {
+	case "VP8 ":
+		if len(p) < 10 {
+			return 0, 0, false, false
+		}
+		w = int(binary.LittleEndian.Uint16(p[6:]) & 0x3FFF)
+		h = int(binary.LittleEndian.Uint16(p[8:]) & 0x3FFF)
+		return w, h, false, true
+	case "VP8L":
+		if len(p) < 5 || p[0] != 0x2F {
+			return 0, 0, false, false
+		}
+		bits := binary.LittleEndian.Uint32(p[1:])
+		w = int(bits&0x3FFF) + 1
+		h = int(bits>>14&0x3FFF) + 1
+		return w, h, bits>>28&1 == 1, true
+	}
+	return 0, 0, false, false
+}
+
+func putUint24(p []byte, v int) {
+	p[0], p[1], p[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+func writeRIFFChunk(w *bytes.Buffer, typ string, payload []byte) {
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(payload)))
+	w.WriteString(typ)
+	w.Write(n[:])
+	w.Write(payload)
+	if len(payload)%2 == 1 {
+		w.WriteByte(0)
+	}
+}
@@ -0,0 +1,246 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+var (
+	testExif = buildTIFF([]testEntry{{tag: 0x0112, typ: 3, count: 1, value: short(6)}})
+	testICC  = []byte("icc profile")
+	testXMP  = []byte("<x:xmpmeta/>")
+)
+
+// testJPEG returns a JPEG with a JFIF segment, metadata segments and a scan.
+func testJPEG() []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, 0xD8})
+	writeSegment(&b, 0xE0, []byte("JFIF\x00"), []byte{1, 1, 0, 0, 1, 0, 1, 0, 0})
+	writeSegment(&b, 0xE1, exifHeader, testExif)
+	writeSegment(&b, 0xE1, xmpHeader, testXMP)
+	writeSegment(&b, 0xE2, append(append([]byte{}, iccHeader...), 1, 1), testICC)
+	b.Write([]byte{0xFF, 0xDA, 0x00, 0x02, 0x01, 0x02, 0xFF, 0xD9})
+	return b.Bytes()
+}
+
+// testPNG returns a PNG with an IHDR chunk, optionally metadata chunks, and
+// an IEND chunk.
+func testPNG(meta bool) []byte {
+	var b bytes.Buffer
+	b.Write(pngHeader)
+	writeChunk(&b, "IHDR", make([]byte, 13))
+	if meta {
+		writeChunk(&b, "eXIf", testExif)
+		writeChunk(&b, "iTXt", append([]byte(xmpKeyword+"\x00\x00\x00\x00\x00"), testXMP...))
+	}
+	writeChunk(&b, "IEND", nil)
+	return b.Bytes()
+}
+
+// testWebP returns a simple lossless WebP of 4x3 pixels, optionally in the
+// extended format with metadata chunks.
+func testWebP(meta bool) []byte {
+	bits := uint32(3) | uint32(2)<<14
+	vp8l := binary.LittleEndian.AppendUint32([]byte{0x2F}, bits)
+
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	if meta {
+		vp8x := make([]byte, 10)
+		vp8x[0] = 0x20 | 0x08 | 0x04
+		putUint24(vp8x[4:], 3)
+		putUint24(vp8x[7:], 2)
+		writeRIFFChunk(&body, "VP8X", vp8x)
+		writeRIFFChunk(&body, "ICCP", testICC)
+	}
+	writeRIFFChunk(&body, "VP8L", vp8l)
+	if meta {
+		writeRIFFChunk(&body, "EXIF", testExif)
+		writeRIFFChunk(&body, "XMP ", testXMP)
+	}
+
+	out := []byte("RIFF")
+	out = binary.LittleEndian.AppendUint32(out, uint32(body.Len()))
+	return append(out, body.Bytes()...)
+}
+
+func TestReadImageMeta(t *testing.T) {
+	tests := []struct {
+		name           string
+		data           []byte
+		exif, icc, xmp []byte
+	}{
+		{name: "jpeg", data: testJPEG(), exif: testExif, icc: testICC, xmp: testXMP},
+		{name: "png", data: testPNG(true), exif: testExif, xmp: testXMP},
+		{name: "webp", data: testWebP(true), exif: testExif, icc: testICC, xmp: testXMP},
+		{name: "png without metadata", data: testPNG(false)},
+		{name: "webp without metadata", data: testWebP(false)},
+		{name: "unknown format", data: []byte("GIF89a")},
+		{name: "empty", data: nil},
+		{name: "jpeg segment longer than the data", data: []byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF, 0xFF, 'E'}},
+		{name: "jpeg segment length below 2", data: []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01}},
+		{name: "jpeg icc segment without sequence", data: append([]byte{0xFF, 0xD8, 0xFF, 0xE2, 0x00, 0x0E}, iccHeader...)},
+		{name: "png chunk longer than the data", data: append(append([]byte{}, pngHeader...), 0x7F, 0xFF, 0xFF, 0xFF, 'e', 'X', 'I', 'f', 0, 0, 0, 0)},
+		{name: "png iCCP without compression method", data: pngWithChunk("iCCP", []byte("name\x00"))},
+		{name: "png iTXt truncated", data: pngWithChunk("iTXt", []byte(xmpKeyword+"\x00\x01"))},
+		{name: "png iTXt invalid zlib", data: pngWithChunk("iTXt", []byte(xmpKeyword+"\x00\x01\x00\x00\x00junk"))},
+		{name: "webp chunk longer than the data", data: []byte("RIFF\x00\x00\x00\x00WEBPEXIF\xFF\xFF\xFF\x7F")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := readImageMeta(tt.data)
+			if !bytes.Equal(m.exif, tt.exif) {
+				t.Errorf("exif = %x, want %x", m.exif, tt.exif)
+			}
+			if !bytes.Equal(m.icc, tt.icc) {
+				t.Errorf("icc = %q, want %q", m.icc, tt.icc)
+			}
+			if !bytes.Equal(m.xmp, tt.xmp) {
+				t.Errorf("xmp = %q, want %q", m.xmp, tt.xmp)
+			}
+		})
+	}
+}
+
+func pngWithChunk(typ string, payload []byte) []byte {
+	var b bytes.Buffer
+	b.Write(pngHeader)
+	writeChunk(&b, typ, payload)
+	return b.Bytes()
+}
+
+func TestReadImageMetaTruncated(t *testing.T) {
+	for _, data := range [][]byte{testJPEG(), testPNG(true), testWebP(true)} {
+		for n := 0; n < len(data); n++ {
+			_ = readImageMeta(data[:n])
+		}
+	}
+}
+
+func TestInjectMeta(t *testing.T) {
+	meta := imageMeta{exif: testExif, icc: testICC, xmp: testXMP}
+
+	tests := []struct {
+		name   string
+		inject func([]byte, imageMeta) []byte
+		data   []byte
+		icc    bool
+	}{
+		{name: "jpeg", inject: injectJPEG, data: testJPEG()[:2+2+16], icc: true},
+		{name: "png", inject: injectPNG, data: testPNG(false)},
+		{name: "webp", inject: injectWebP, data: testWebP(false), icc: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := tt.inject(tt.data, meta)
+			m := readImageMeta(out)
+			if !bytes.Equal(m.exif, testExif) {
+				t.Errorf("exif = %x, want %x", m.exif, testExif)
+			}
+			if !bytes.Equal(m.xmp, testXMP) {
+				t.Errorf("xmp = %q, want %q", m.xmp, testXMP)
+			}
+			if tt.icc && !bytes.Equal(m.icc, testICC) {
+				t.Errorf("icc = %q, want %q", m.icc, testICC)
+			}
+
+			if got := tt.inject(tt.data, imageMeta{}); !bytes.Equal(got, tt.data) {
+				t.Error("empty metadata changed the image")
+			}
+		})
+	}
+}
+
+func TestReadJPEGMetaAdobe(t *testing.T) {
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, 0xD8})
+	writeSegment(&b, 0xEE, []byte("Adobe"), []byte{0, 100, 0, 0, 0, 0, 0})
+	b.Write([]byte{0xFF, 0xD9})
+
+	if m := readImageMeta(b.Bytes()); !m.empty() {
+		t.Errorf("APP14 Adobe segment kept: %q", m.raw)
+	}
+}
+
+// testProfile returns an ICC profile header of the colour space space.
+func testProfile(space string) []byte {
+	icc := make([]byte, 128)
+	copy(icc[16:], space)
+	return icc
+}
+
+func TestInjectJPEGProfile(t *testing.T) {
+	var enc bytes.Buffer
+	if err := jpeg.Encode(&enc, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		space string
+		keep  bool
+	}{
+		{name: "rgb", space: "RGB ", keep: true},
+		{name: "cmyk", space: "CMYK"},
+		{name: "gray", space: "GRAY"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			icc := testProfile(tt.space)
+			var src bytes.Buffer
+			src.Write([]byte{0xFF, 0xD8})
+			writeSegment(&src, 0xE2, append(append([]byte{}, iccHeader...), 1, 1), icc)
+			src.Write([]byte{0xFF, 0xD9})
+
+			for _, meta := range []imageMeta{readImageMeta(src.Bytes()), {icc: icc}} {
+				got := readImageMeta(injectJPEG(enc.Bytes(), meta)).icc
+				if kept := bytes.Equal(got, icc); kept != tt.keep {
+					t.Errorf("profile kept %v, want %v", kept, tt.keep)
+				}
+			}
+		})
+	}
+}
+
+func TestInjectMetaMalformed(t *testing.T) {
+	meta := imageMeta{exif: testExif, icc: testICC, xmp: testXMP}
+
+	tests := []struct {
+		name   string
+		inject func([]byte, imageMeta) []byte
+		data   []byte
+	}{
+		{name: "jpeg without start of image", inject: injectJPEG, data: []byte("not a jpeg")},
+		{name: "jpeg jfif segment longer than the data", inject: injectJPEG, data: []byte{0xFF, 0xD8, 0xFF, 0xE0, 0xFF, 0xFF}},
+		{name: "png without header", inject: injectPNG, data: []byte("not a png")},
+		{name: "png truncated ihdr", inject: injectPNG, data: testPNG(false)[:20]},
+		{name: "webp without header", inject: injectWebP, data: []byte("RIFF\x00\x00\x00\x00WAVEfmt ")},
+		{name: "webp chunk longer than the data", inject: injectWebP, data: []byte("RIFF\x00\x00\x00\x00WEBPVP8L\xFF\xFF\xFF\x7F")},
+		{name: "webp unknown frame", inject: injectWebP, data: []byte("RIFF\x00\x00\x00\x00WEBPVP8 \x02\x00\x00\x00\x00\x00")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.inject(tt.data, meta); !bytes.Equal(got, tt.data) {
+				t.Errorf("malformed image changed: %q", got)
+			}
+		})
+	}
+}
+
+func TestInjectMetaTruncated(t *testing.T) {
+	meta := imageMeta{exif: testExif, icc: testICC, xmp: testXMP}
+	for _, data := range [][]byte{testJPEG(), testPNG(false), testWebP(true)} {
+		for n := 0; n < len(data); n++ {
+			_ = injectJPEG(data[:n], meta)
+			_ = injectPNG(data[:n], meta)
+			_ = injectWebP(data[:n], meta)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/storage"
+)
+
+func NewOriginalReader(builder Builder) *Original {
+	return &Original{builder: builder, file: NewFileReader(builder)}
+}
+
+// Original stores an image untouched, RAW, HEIC or TIFF, with an optional
+// JPEG preview in the previews of the destination.
+type Original struct {
+	builder Builder
+	file    *File
+}
+
+func (o *Original) Open(lPath string, subPath []string) error {
+	dstName, sum, err := o.file.put(lPath, subPath)
+	if err != nil || !config.FileSystemCfg.Compress.Preview {
+		return err
+	}
+
+	// the original is stored, a missing preview tool does not fail the backup
+	if err := o.preview(lPath, storage.PreviewName(dstName), sum); err != nil {
+		logger.Error().Str("path", lPath).Err(err).Msg("image preview")
+	}
+	return nil
+}
+
+func (o *Original) preview(lPath, previewName, sum string) error {
+	duration := time.Now()
+	tmpPath, cleanup, err := tempPath(".jpg")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if err := jpegPreview(lPath, tmpPath); err != nil {
+		return err
+	}
+	if _, err := compressGo(config.FileSystemCfg.Compress.Quality, tmpPath); err != nil {
+		return err
+	}
+
+	meta := storage.Metadata{storage.MetaSum: sum, storage.MetaFormat: "jpeg"}
+	if err := o.builder.copy(tmpPath, previewName, meta); err != nil {
+		return err
+	}
+	logger.Info(time.Since(duration)).Str("path", lPath).Msg("image preview is done")
+	return nil
+}
+
+// jpegPreview writes a JPEG of the image at lPath to dst. A RAW file has an
+// embedded preview which is extracted by exiftool, HEIC is converted with
+// heif-convert and other formats with ImageMagick.
+func jpegPreview(lPath, dst string) error {
+	switch strings.ToLower(filepath.Ext(lPath)) {
+	case ".heic", ".heif":
+		return run(exec.Command("heif-convert", "-q", "90", lPath, dst))
+	case ".tif", ".tiff", ".psd":
+		return run(exec.Command("convert", lPath+"[0]", "-quality", "90", dst))
+	}
+
+	for _, tag := range []string{"-PreviewImage", "-JpgFromRaw"} {
+		out, err := exec.Command("exiftool", "-b", tag, lPath).Output()
+		if err != nil {
+			return err
+		}
+		if len(out) > 0 {
+			return os.WriteFile(dst, out, 0600)
+		}
+	}
+	return errors.New("no embedded preview")
+}
@@ -0,0 +1,39 @@
+package core
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/hinha/watchgo/config"
+)
+
+// SubPath splits lPath into the watched root and the path inside of it, the
+// same way the periodic sync does. A path outside of the watched roots is
+// split at its parent folder.
+func SubPath(lPath string) []string {
+	lPath = filepath.Clean(lPath)
+	for _, root := range config.FileSystemCfg.PathList() {
+		root = filepath.Clean(root)
+		if strings.HasPrefix(lPath, root+string(filepath.Separator)) {
+			return []string{root, lPath[len(root):]}
+		}
+	}
+
+	dir, file := filepath.Split(lPath)
+	return []string{filepath.Clean(dir), file}
+}
+
+// BackupName returns the name lPath is stored under in a destination. A
+// watched root is stored as the folder named after it.
+func BackupName(lPath string) string {
+	lPath = filepath.Clean(lPath)
+	for _, root := range config.FileSystemCfg.PathList() {
+		if filepath.Clean(root) == lPath {
+			return filepath.Base(lPath)
+		}
+	}
+
+	var b builder
+	return path.Join(b.folder(SubPath(lPath)), filepath.Base(lPath))
+}
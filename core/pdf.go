@@ -0,0 +1,127 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/storage"
+)
+
+// pdf optimisers.
+const (
+	optimizerGhostscript = "gs"
+	optimizerQPDF        = "qpdf"
+)
+
+func NewPDFReader(builder Builder) *PDF {
+	return &PDF{builder: builder, file: NewFileReader(builder)}
+}
+
+// PDF stores a document optimised by Ghostscript, which downsamples embedded
+// images, or qpdf, which removes unused objects. Without optimiser the
+// document is stored as other files.
+type PDF struct {
+	builder Builder
+	file    *File
+}
+
+func (p *PDF) Open(lPath string, subPath []string) error {
+	cfg := config.FileSystemCfg.Compress.PDF
+	if cfg.Optimizer == "" {
+		return p.file.Open(lPath, subPath)
+	}
+
+	fi, err := os.Stat(lPath)
+	if err != nil {
+		return err
+	}
+
+	lPath = filepath.Clean(lPath)
+	dstName := path.Join(p.builder.folder(subPath), fi.Name())
+	sum, err := p.builder.checksum(lPath)
+	if err != nil {
+		return err
+	}
+	meta := storage.Metadata{storage.MetaSum: sum}
+
+	tmpPath, cleanup, err := tempPath(".pdf")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if err := optimizePDF(cfg, lPath, tmpPath, fi.Size()); err != nil {
+		logger.Error().Str("path", lPath).Str("optimizer", cfg.Optimizer).Err(err).Msg("optimize pdf")
+		return p.builder.copy(lPath, dstName, meta)
+	}
+
+	opt, err := os.Stat(tmpPath)
+	if err != nil || opt.Size() >= fi.Size() {
+		logger.Info(0).Str("path", lPath).Msg("file already compressed")
+		return p.builder.copy(lPath, dstName, meta)
+	}
+	return p.builder.copy(tmpPath, dstName, meta)
+}
+
+// optimizePDF writes the optimised document src to dst.
+func optimizePDF(cfg config.PDFConfig, src, dst string, beforeSize int64) error {
+	duration := time.Now()
+
+	var cmd *exec.Cmd
+	switch cfg.Optimizer {
+	case optimizerGhostscript:
+		dpi := cfg.DPI
+		if dpi == 0 {
+			dpi = 150
+		}
+		res := strconv.Itoa(dpi)
+		cmd = exec.Command("gs",
+			"-sDEVICE=pdfwrite",
+			"-dCompatibilityLevel=1.5",
+			"-dNOPAUSE", "-dQUIET", "-dBATCH", "-dSAFER",
+			"-dDetectDuplicateImages=true",
+			"-dDownsampleColorImages=true", "-dColorImageResolution="+res,
+			"-dDownsampleGrayImages=true", "-dGrayImageResolution="+res,
+			"-dDownsampleMonoImages=true", "-dMonoImageResolution="+res,
+			"-sOutputFile="+dst,
+			src)
+	case optimizerQPDF:
+		cmd = exec.Command("qpdf",
+			"--object-streams=generate",
+			"--compress-streams=y",
+			"--recompress-flate",
+			"--remove-unreferenced-resources=yes",
+			src, dst)
+	default:
+		return fmt.Errorf("unknown pdf optimizer %q", cfg.Optimizer)
+	}
+	if err := run(cmd); err != nil && !qpdfWarning(cfg, dst, err) {
+		return err
+	}
+
+	fl, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	logger.Info(time.Since(duration)).Str("path", src).Str("optimizer", cfg.Optimizer).Msg(fmt.Sprintf("compress file is done, filesize before %d, after %d", beforeSize, fl.Size()))
+	return nil
+}
+
+// qpdfWarning reports whether err is the exit code 3 of qpdf, it wrote dst
+// but warned about the document, which is common for real world documents.
+func qpdfWarning(cfg config.PDFConfig, dst string, err error) bool {
+	var exitErr *exec.ExitError
+	if cfg.Optimizer != optimizerQPDF || !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		return false
+	}
+	_, err = os.Stat(dst)
+	return err == nil
+}
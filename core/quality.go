@@ -0,0 +1,141 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// stdLuminance is the luminance quantization table of the JPEG standard in
+// zigzag order, encoders scale it by the quality like libjpeg does.
+var stdLuminance = [64]int{
+	16, 11, 12, 14, 12, 10, 16, 14, 13, 14, 18, 17, 16, 19, 24, 40,
+	26, 24, 22, 22, 24, 49, 35, 37, 29, 40, 58, 51, 61, 60, 57, 51,
+	56, 55, 64, 72, 92, 78, 64, 68, 87, 69, 55, 56, 80, 109, 81, 87,
+	95, 98, 103, 104, 103, 62, 77, 113, 121, 112, 100, 120, 92, 101, 103, 99,
+}
+
+var errNoDQT = errors.New("jpeg has no quantization table")
+
+// jpegQuality estimates the quality a JPEG was encoded with from its luminance
+// quantization table, it replaces `identify -format %Q`.
+func jpegQuality(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil {
+		return 0, err
+	}
+	if soi[0] != 0xFF || soi[1] != 0xD8 {
+		return 0, errors.New("not a jpeg")
+	}
+
+	for {
+		marker, err := nextMarker(br)
+		if err != nil {
+			return 0, err
+		}
+		// start of scan or end of image, every table is defined before it
+		if marker == 0xDA || marker == 0xD9 {
+			return 0, errNoDQT
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			continue
+		}
+
+		var l [2]byte
+		if _, err := io.ReadFull(br, l[:]); err != nil {
+			return 0, err
+		}
+		n := int(binary.BigEndian.Uint16(l[:])) - 2
+		if n < 0 {
+			return 0, errors.New("invalid jpeg segment")
+		}
+		seg := make([]byte, n)
+		if _, err := io.ReadFull(br, seg); err != nil {
+			return 0, err
+		}
+		if marker != 0xDB {
+			continue
+		}
+		if q, ok := dqtQuality(seg); ok {
+			return q, nil
+		}
+	}
+}
+
+// nextMarker skips to the next marker and returns its code.
+func nextMarker(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != 0xFF {
+			continue
+		}
+		for b == 0xFF {
+			if b, err = br.ReadByte(); err != nil {
+				return 0, err
+			}
+		}
+		if b != 0 {
+			return b, nil
+		}
+	}
+}
+
+// dqtQuality returns the quality of the luminance table (id 0) in a DQT
+// segment.
+func dqtQuality(seg []byte) (int, bool) {
+	for len(seg) > 0 {
+		precision, id := seg[0]>>4, seg[0]&0x0F
+		size := 64
+		if precision == 1 {
+			size = 128
+		}
+		if len(seg) < 1+size {
+			return 0, false
+		}
+		table := seg[1 : 1+size]
+		seg = seg[1+size:]
+		if id != 0 {
+			continue
+		}
+
+		var sum, std int
+		for i := 0; i < 64; i++ {
+			v := int(table[i])
+			if precision == 1 {
+				v = int(binary.BigEndian.Uint16(table[2*i:]))
+			}
+			if precision == 0 && v == 255 {
+				// clamped by a low quality, it says nothing about the scale
+				continue
+			}
+			sum += v
+			std += stdLuminance[i]
+		}
+
+		// invert the libjpeg scaling: scale = 5000/q below 50, 200-2q above
+		if std == 0 {
+			return 1, true
+		}
+		scale := float64(sum) * 100 / float64(std)
+		var q float64
+		if scale <= 100 {
+			q = (200 - scale) / 2
+		} else {
+			q = 5000 / scale
+		}
+		quality := int(q + 0.5)
+		if quality < 1 {
+			quality = 1
+		}
+		if quality > 100 {
+			quality = 100
+		}
+		return quality, true
+	}
+	return 0, false
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"time"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/storage"
+)
+
+const (
+	defaultThumbSize    = 256
+	defaultThumbQuality = 75
+)
+
+// thumbnail stores a JPEG of the image at lPath scaled down to the configured
+// size as thumbName. The orientation of the source is kept so a viewer rotates
+// the thumbnail the same way.
+func thumbnail(b Builder, lPath, thumbName, sum string) error {
+	duration := time.Now()
+	data, err := os.ReadFile(lPath)
+	if err != nil {
+		return err
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	cfg := config.FileSystemCfg.Thumbnails
+	size, quality := cfg.Size, cfg.Quality
+	if size <= 0 {
+		size = defaultThumbSize
+	}
+	if quality <= 0 {
+		quality = defaultThumbQuality
+	}
+
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, h*size/w
+		} else {
+			w, h = w*size/h, size
+		}
+	}
+	if w == 0 {
+		w = 1
+	}
+	if h == 0 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality}); err != nil {
+		return err
+	}
+	meta := readImageMeta(data).filter(metadataAllowlist, []string{"Orientation"})
+
+	tmpPath, cleanup, err := tempPath(".jpg")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if err := os.WriteFile(tmpPath, injectJPEG(buf.Bytes(), meta), 0600); err != nil {
+		return err
+	}
+
+	if err := b.copy(tmpPath, thumbName, storage.Metadata{storage.MetaSum: sum, storage.MetaFormat: "jpeg"}); err != nil {
+		return err
+	}
+	logger.Info(time.Since(duration)).Str("path", lPath).Msg("image thumbnail is done")
+	return nil
+}
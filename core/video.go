@@ -0,0 +1,146 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/storage"
+	"github.com/hinha/watchgo/utils"
+)
+
+// defaults of the video profile.
+const (
+	defaultVideoCommand = "ffmpeg"
+	defaultVideoCodec   = "libx265"
+	defaultVideoBitrate = "4M"
+	defaultVideoMaxSize = 4096
+)
+
+// errSizeLimit rejects a file exceeding max_file_size which is not stored
+// transcoded.
+var errSizeLimit = errors.New("size limit")
+
+func NewVideoReader(builder Builder) *Video {
+	return &Video{builder: builder, file: NewFileReader(builder)}
+}
+
+// Video stores a video of at least min_size transcoded by an external
+// encoder. A smaller video is stored as other files.
+type Video struct {
+	builder Builder
+	file    *File
+}
+
+// Transcodable reports whether lPath is a video of size bytes which reaches
+// min_size, Default value - max_file_size, and is transcoded by the video
+// profile. Without both no video is transcoded.
+func Transcodable(lPath string, size int64) bool {
+	cfg := config.FileSystemCfg.Compress.Video
+	if !cfg.Enabled || handlerName(lPath) != handlerVideo {
+		return false
+	}
+
+	minSize := cfg.MinSize
+	if minSize == 0 {
+		minSize = config.FileSystemCfg.MaxFileSize
+	}
+	maxSize := cfg.MaxSize
+	if maxSize == 0 {
+		maxSize = defaultVideoMaxSize
+	}
+	return minSize > 0 && size >= minSize*int64(utils.MB) && size < maxSize*int64(utils.MB)
+}
+
+// oversized returns an errSizeLimit error when size exceeds max_file_size,
+// zero is unlimited.
+func oversized(size int64) error {
+	maxSize := utils.ByteSize(config.FileSystemCfg.MaxFileSize) * utils.MB
+	if maxSize == 0 || utils.ByteSize(size) < maxSize {
+		return nil
+	}
+	return fmt.Errorf("%w %s, of maximum %s", errSizeLimit, utils.ByteSize(size).String(), maxSize.String())
+}
+
+// Open transcodes lPath, a video exceeding max_file_size is rejected unless
+// it is stored transcoded and smaller.
+func (v *Video) Open(lPath string, subPath []string) error {
+	duration := time.Now()
+	fi, err := os.Stat(lPath)
+	if err != nil {
+		return err
+	}
+	if !Transcodable(lPath, fi.Size()) {
+		return v.file.Open(lPath, subPath)
+	}
+
+	lPath = filepath.Clean(lPath)
+	dstName := path.Join(v.builder.folder(subPath), fi.Name())
+	sum, err := v.builder.checksum(lPath)
+	if err != nil {
+		return err
+	}
+	meta := storage.Metadata{storage.MetaSum: sum}
+
+	tmpPath, cleanup, err := tempPath(filepath.Ext(lPath))
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	cfg := config.FileSystemCfg.Compress.Video
+	if err := transcode(cfg, lPath, tmpPath); err != nil {
+		logger.Error().Str("path", lPath).Str("command", cfg.Command).Err(err).Msg("transcode video")
+		if err := oversized(fi.Size()); err != nil {
+			return err
+		}
+		return v.builder.copy(lPath, dstName, meta)
+	}
+
+	out, err := os.Stat(tmpPath)
+	if err != nil || out.Size() >= fi.Size() {
+		logger.Info(0).Str("path", lPath).Msg("file already compressed")
+		if err := oversized(fi.Size()); err != nil {
+			return err
+		}
+		return v.builder.copy(lPath, dstName, meta)
+	}
+	logger.Info(time.Since(duration)).
+		Str("path", lPath).
+		Str("before", utils.ByteSize(fi.Size()).String()).
+		Str("after", utils.ByteSize(out.Size()).String()).
+		Msg("transcode video is done")
+	return v.builder.copy(tmpPath, dstName, meta)
+}
+
+// transcode writes the video src encoded with the codec and bitrate of cfg to
+// dst, the audio and metadata streams are copied.
+func transcode(cfg config.VideoConfig, src, dst string) error {
+	command, codec, bitrate := cfg.Command, cfg.Codec, cfg.Bitrate
+	if command == "" {
+		command = defaultVideoCommand
+	}
+	if codec == "" {
+		codec = defaultVideoCodec
+	}
+	if bitrate == "" {
+		bitrate = defaultVideoBitrate
+	}
+
+	cmd := exec.Command(command,
+		"-y", "-loglevel", "error",
+		"-i", src,
+		"-map", "0",
+		"-map_metadata", "0",
+		"-c", "copy",
+		"-c:v", codec,
+		"-b:v", bitrate,
+		dst)
+	return run(cmd)
+}
@@ -2,75 +2,476 @@ package fswatch
 
 import (
 	"context"
+	"errors"
 	"github.com/fsnotify/fsnotify"
-	"regexp"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/hinha/watchgo/config"
 	"github.com/hinha/watchgo/core"
+	"github.com/hinha/watchgo/index"
+	"github.com/hinha/watchgo/logger"
 	"github.com/hinha/watchgo/utils"
 )
 
+// renameWindow is the time the new name of a renamed file is expected in,
+// the watcher reports it as create right after the rename of the old name.
+var renameWindow = 500 * time.Millisecond
+
+// trackWindow is the time the writes of a file created by an event are backed
+// up after its last change whatever events.write, a download or copy may
+// pause longer than the debounce.
+var trackWindow = 10 * time.Minute
+
+// defaultDebounce seconds the size and modification time of a file have to be
+// unchanged before it is backed up.
+const defaultDebounce = 2
+
+// job operations of the workers.
+const (
+	jobBackup = iota
+	jobRename
+	jobRemove
+)
+
+// job is a change of the watched files, oldName is set for a rename. A job
+// waits for the jobs sent before it on the same names, done is closed once it
+// is processed.
+type job struct {
+	op      int
+	name    string
+	oldName string
+
+	wait []chan struct{}
+	done chan struct{}
+}
+
 // ProcessEvent construct.
 type ProcessEvent struct {
-	ctx context.Context
+	ctx   context.Context
+	dests []*core.Destination
+	index *index.Index
 
-	image *core.Image
-	file  *core.File
+	watcher *FSWatcher
+	jobs    chan job
+	mu      sync.Mutex
+	pending map[string]*pendingFile
+	// tracked is the last change of the files created by an event
+	tracked map[string]time.Time
+	// last is the done channel of the last job sent on a name, sendMu keeps
+	// the queue in the order of last
+	sendMu sync.Mutex
+	lastMu sync.Mutex
+	last   map[string]chan struct{}
 }
 
 // NewEvent cmd wrapper.
-func NewEvent(ctx context.Context) *ProcessEvent {
+func NewEvent(ctx context.Context, dests []*core.Destination, idx *index.Index) *ProcessEvent {
 	return &ProcessEvent{
-		ctx: ctx,
+		ctx:     ctx,
+		dests:   dests,
+		index:   idx,
+		jobs:    make(chan job, config.General.WorkerBuffer),
+		pending: make(map[string]*pendingFile),
+		tracked: make(map[string]time.Time),
+		last:    make(map[string]chan struct{}),
 	}
 }
 
-func (p *ProcessEvent) Run(event chan fsnotify.Event) {
-	builder := core.NewBuilder()
-	p.image = core.NewImageReader(builder)
-	p.file = core.NewFileReader(builder)
+// Run dispatches the events in order and processes them with the workers. The
+// folders watched by w follow the created, removed and renamed folders.
+func (p *ProcessEvent) Run(event chan fsnotify.Event, w *FSWatcher) {
+	p.watcher = w
+	go p.dispatch(event)
 	for i := 0; i < config.General.Worker; i++ {
-		go p.process(event)
+		go p.process()
 	}
 }
 
-func (p *ProcessEvent) process(event chan fsnotify.Event) {
-	reImage, err := regexp.Compile(core.Regexp())
-	if err != nil {
-		return
-	}
+// dispatch turns the events into jobs. A rename is paired with the create of
+// the new name, a rename without one is a remove. A created file, and with
+// events.write a written file, is backed up once it is stable, the later
+// writes of a created file are backed up too. A created folder is watched and
+// the files in it are backed up, unless it is a renamed folder which backups
+// are moved.
+func (p *ProcessEvent) dispatch(event chan fsnotify.Event) {
+	// renamed is the old name waiting for its create, dirty when it had a
+	// pending backup
+	var renamed string
+	var dirty bool
+	renameTimer := time.NewTimer(renameWindow)
+	stopTimer(renameTimer)
+
 	for {
 		select {
 		case evt := <-event:
-			if evt.Op&(fsnotify.Create) > 0 {
-				if strings.HasSuffix(evt.Name, "~") {
-					evt.Name = evt.Name[:len(evt.Name)-1]
+			name := evt.Name
+			switch {
+			case evt.Op&fsnotify.Create > 0:
+				files, isDir := p.watch(evt.Name)
+				if editorBackup(name) {
+					// the editor renamed name to name~ and writes name again,
+					// the old name is not removed
+					if renamed == strings.TrimSuffix(name, "~") {
+						stopTimer(renameTimer)
+						renamed = ""
+					}
+					name = strings.TrimSuffix(name, "~")
 				}
-
-				if utils.IgnoreExtension(evt.Name) {
+				if renamed != "" {
+					stopTimer(renameTimer)
+					oldName := renamed
+					renamed = ""
+					if p.isRename(oldName, name) {
+						p.send(job{op: jobRename, name: name, oldName: oldName})
+						if dirty {
+							p.track(name)
+						}
+						if isDir && !core.RenameKeepsBackups() {
+							p.backfill(files)
+						}
+						continue
+					}
+					p.send(job{op: jobRemove, name: oldName})
+				}
+				if isDir {
+					p.backfill(files)
 					continue
 				}
-
-				fsp := strings.SplitAfterN(evt.Name, "/", -1)
-				fxt := strings.Join(fsp[len(fsp)-1:], "")
-				fd := strings.Join(fsp[:len(fsp)-1], "")
-				var subFolder string
-				if len(fd) > 1 {
-					subFolder = fd[:len(fd)-1]
-				} else {
-					subFolder = ""
+				p.track(name)
+			case editorBackup(name):
+				// the write, rename and remove of an editor backup
+			case evt.Op&fsnotify.Write > 0:
+				p.written(name)
+			case evt.Op&fsnotify.Rename > 0:
+				if renamed != "" {
+					p.send(job{op: jobRemove, name: renamed})
 				}
+				p.unwatch(name)
+				stopTimer(renameTimer)
+				renamed, dirty = name, p.cancel(name)
+				renameTimer.Reset(renameWindow)
+			case evt.Op&fsnotify.Remove > 0:
+				p.unwatch(name)
+				p.cancel(name)
+				p.send(job{op: jobRemove, name: name})
+			}
+		case <-renameTimer.C:
+			// moved out of the watched paths
+			if renamed != "" {
+				p.send(job{op: jobRemove, name: renamed})
+				renamed = ""
+			}
+		case <-p.ctx.Done():
+			renameTimer.Stop()
+			return
+		}
+	}
+}
 
-				subPath := []string{subFolder, fxt}
-				if reImage.MatchString(evt.Name) {
-					_ = p.image.Open(evt.Name, subPath)
-				} else {
-					_ = p.file.Open(evt.Name, subPath)
-				}
+// editorBackup reports whether name is the backup copy "name~" of an editor.
+// A created one is backed up as name, its other events are ignored.
+func editorBackup(name string) bool {
+	return strings.HasSuffix(name, "~")
+}
+
+// watch adds the watches of the created folder name, it returns the files in
+// it. It reports false when name is not a folder.
+func (p *ProcessEvent) watch(name string) ([]string, bool) {
+	fi, err := os.Stat(name)
+	if err != nil || !fi.IsDir() || p.watcher == nil {
+		return nil, false
+	}
+
+	files, err := p.watcher.watches.add(name)
+	if errors.Is(err, syscall.ENOSPC) {
+		// the files of the folder are found by the rescan
+		root := core.SubPath(name)[0]
+		go func() {
+			if p.watcher.degrade(root, err) {
+				p.watcher.Rescan(root)
 			}
+		}()
+		return nil, true
+	}
+	if err != nil {
+		logger.Error().Str("path", name).Err(err).Msg("watch folder")
+	}
+	return files, true
+}
+
+// unwatch drops the watches of the removed or renamed folder name.
+func (p *ProcessEvent) unwatch(name string) {
+	if p.watcher != nil {
+		p.watcher.watches.drop(name)
+	}
+}
+
+// backfill backs up the files of a created folder, they may have been written
+// before the folder was watched.
+func (p *ProcessEvent) backfill(files []string) {
+	for _, name := range files {
+		p.track(name)
+	}
+}
+
+// isRename reports whether newName is the renamed file oldName, it needs the
+// index entry of oldName with the size and modification time of newName. A
+// folder needs an entry below oldName found below newName. Without one the
+// events are a remove and a create.
+func (p *ProcessEvent) isRename(oldName, newName string) bool {
+	fi, err := os.Stat(newName)
+	if err != nil {
+		return false
+	}
+	if !fi.IsDir() {
+		return p.sameEntry(oldName, newName)
+	}
+
+	// one file decides, the rename keeps the files below the folder
+	errFound := errors.New("found")
+	var found bool
+	err = p.index.Walk(oldName, func(e index.Entry) error {
+		rel := strings.TrimPrefix(e.Path, filepath.Clean(oldName))
+		found = p.sameEntry(e.Path, newName+rel)
+		return errFound
+	})
+	return found && errors.Is(err, errFound)
+}
+
+// sameEntry reports whether the file newName has the size and modification
+// time recorded in the index entry of oldName.
+func (p *ProcessEvent) sameEntry(oldName, newName string) bool {
+	fi, err := os.Stat(newName)
+	if err != nil {
+		return false
+	}
+	e, ok, err := p.index.Get(oldName)
+	if err != nil || !ok {
+		return false
+	}
+	return e.Size == fi.Size() && e.ModTime.Equal(fi.ModTime())
+}
+
+// pendingFile is a created or written file waiting to be stable, size and
+// modTime are its state at the last event.
+type pendingFile struct {
+	timer   *time.Timer
+	size    int64
+	modTime time.Time
+}
+
+// quietPeriod is the time a file has to be unchanged before it is backed up.
+func quietPeriod() time.Duration {
+	debounce := config.FileSystemCfg.Events.Debounce
+	if debounce <= 0 {
+		debounce = defaultDebounce
+	}
+	return time.Duration(debounce) * time.Second
+}
+
+// changed backs up name once it is stable, the events of a pending file are
+// coalesced into one backup.
+func (p *ProcessEvent) changed(name string) {
+	fi, err := os.Stat(name)
+	if err != nil || fi.IsDir() {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, ok := p.pending[name]
+	if !ok {
+		f = &pendingFile{}
+		f.timer = time.AfterFunc(quietPeriod(), func() { p.settle(name, f) })
+		p.pending[name] = f
+	} else {
+		f.timer.Reset(quietPeriod())
+	}
+	f.size, f.modTime = fi.Size(), fi.ModTime()
+}
+
+// track backs up the file name created by an event once it is stable, its
+// writes are backed up until it did not change for trackWindow.
+func (p *ProcessEvent) track(name string) {
+	p.mu.Lock()
+	p.tracked[name] = time.Now()
+	p.mu.Unlock()
+	p.changed(name)
+}
+
+// written coalesces a write into the pending backup of name and backs up a
+// tracked file again, with events.write it backs up every written file.
+func (p *ProcessEvent) written(name string) {
+	p.mu.Lock()
+	_, ok := p.pending[name]
+	last, tracked := p.tracked[name]
+	if tracked && time.Since(last) > trackWindow {
+		delete(p.tracked, name)
+		tracked = false
+	} else if tracked {
+		p.tracked[name] = time.Now()
+	}
+	p.mu.Unlock()
+
+	if ok || tracked || config.FileSystemCfg.Events.Write {
+		p.changed(name)
+	}
+}
+
+// untrack stops tracking name once it did not change for trackWindow.
+func (p *ProcessEvent) untrack(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if last, ok := p.tracked[name]; ok && time.Since(last) >= trackWindow {
+		delete(p.tracked, name)
+	}
+}
+
+// settle backs up name when its size and modification time did not change
+// during the quiet period, a file still being written is checked again.
+func (p *ProcessEvent) settle(name string, f *pendingFile) {
+	fi, err := os.Stat(name)
+
+	p.mu.Lock()
+	if p.pending[name] != f {
+		// canceled or replaced
+		p.mu.Unlock()
+		return
+	}
+	if err == nil && (fi.Size() != f.size || !fi.ModTime().Equal(f.modTime)) {
+		f.size, f.modTime = fi.Size(), fi.ModTime()
+		f.timer.Reset(quietPeriod())
+		p.mu.Unlock()
+		return
+	}
+	delete(p.pending, name)
+	if _, ok := p.tracked[name]; ok {
+		time.AfterFunc(trackWindow, func() { p.untrack(name) })
+	}
+	p.mu.Unlock()
+
+	if err == nil {
+		p.send(job{op: jobBackup, name: name})
+	}
+}
+
+// cancel drops the pending backup and the tracking of name, it reports
+// whether there was a pending backup.
+func (p *ProcessEvent) cancel(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.tracked, name)
+	f, ok := p.pending[name]
+	if ok {
+		f.timer.Stop()
+		delete(p.pending, name)
+	}
+	return ok
+}
+
+// stopTimer stops t and drains its channel, so it can be reset.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+// send queues j after the jobs sent before it on its names, the workers
+// process the jobs of a name in order.
+func (p *ProcessEvent) send(j job) {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+
+	j.done = make(chan struct{})
+	p.lastMu.Lock()
+	for _, name := range j.names() {
+		if done, ok := p.last[name]; ok {
+			j.wait = append(j.wait, done)
+		}
+		p.last[name] = j.done
+	}
+	p.lastMu.Unlock()
+
+	select {
+	case p.jobs <- j:
+	case <-p.ctx.Done():
+	}
+}
+
+func (j job) names() []string {
+	if j.oldName == "" || j.oldName == j.name {
+		return []string{j.name}
+	}
+	return []string{j.name, j.oldName}
+}
+
+// finish releases the jobs waiting for j.
+func (p *ProcessEvent) finish(j job) {
+	p.lastMu.Lock()
+	for _, name := range j.names() {
+		if p.last[name] == j.done {
+			delete(p.last, name)
+		}
+	}
+	p.lastMu.Unlock()
+	close(j.done)
+}
+
+func (p *ProcessEvent) process() {
+	for {
+		select {
+		case j := <-p.jobs:
+			// the jobs waited for were taken from the queue before j
+			if !p.await(j) {
+				return
+			}
+			p.do(j)
+			p.finish(j)
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// await waits for the jobs j waits for, it reports false when ctx is done.
+func (p *ProcessEvent) await(j job) bool {
+	for _, done := range j.wait {
+		select {
+		case <-done:
 		case <-p.ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+func (p *ProcessEvent) do(j job) {
+	switch j.op {
+	case jobBackup:
+		if utils.IgnoreExtension(j.name) {
+			return
+		}
+		if fi, err := os.Stat(j.name); err != nil || !fi.Mode().IsRegular() {
+			return
+		}
+
+		subPath := core.SubPath(j.name)
+		core.Backup(p.dests, j.name, subPath)
+	case jobRename:
+		// a folder is moved with the backups below it
+		if fi, err := os.Stat(j.name); err != nil || !fi.IsDir() && utils.IgnoreExtension(j.name) {
 			return
 		}
+		core.Rename(p.dests, j.oldName, j.name)
+	case jobRemove:
+		core.Remove(p.dests, j.name)
 	}
 }
@@ -0,0 +1,289 @@
+//go:build linux
+
+package fswatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/sys/unix"
+
+	"github.com/hinha/watchgo/logger"
+)
+
+// fanotifyMask events of the marked filesystems, folders report them too. A
+// written file is reported when it is closed.
+const fanotifyMask = unix.FAN_CREATE | unix.FAN_DELETE | unix.FAN_MOVED_FROM | unix.FAN_MOVED_TO |
+	unix.FAN_CLOSE_WRITE | unix.FAN_ONDIR
+
+// maxCachedDirs folders resolved by handle before the cache is reset.
+const maxCachedDirs = 4096
+
+// fanotifyRoot is a watched path, real is the path as the kernel reports it.
+type fanotifyRoot struct {
+	path string
+	real string
+}
+
+// fanotify reports the changes of whole filesystems with one mark each, the
+// changes below the watched paths are sent as fsnotify events.
+type fanotify struct {
+	ctx    context.Context
+	f      *os.File
+	events chan<- fsnotify.Event
+	errors func(error)
+	roots  []fanotifyRoot
+
+	// mounts is an open folder by filesystem id, the folder handles of the
+	// events are opened relative to it
+	mounts map[[2]int32]int
+	// dirs caches the path of a folder handle, empty outside the watched paths
+	dirs map[string]string
+}
+
+// watchMounts marks the filesystems of paths and sends their changes to
+// events until ctx is done, a lost event or failed read is passed to errs. It
+// needs CAP_SYS_ADMIN and Linux 5.9.
+func watchMounts(ctx context.Context, paths []string, events chan<- fsnotify.Event, errs func(error)) error {
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK|unix.FAN_REPORT_DFID_NAME,
+		unix.O_RDONLY|unix.O_LARGEFILE)
+	if err != nil {
+		return fmt.Errorf("fanotify init: %w", err)
+	}
+
+	n := &fanotify{
+		ctx:    ctx,
+		events: events,
+		errors: errs,
+		mounts: make(map[[2]int32]int),
+		dirs:   make(map[string]string),
+	}
+	for _, p := range paths {
+		if err := n.mark(fd, p); err != nil {
+			n.closeMounts()
+			_ = unix.Close(fd)
+			return err
+		}
+	}
+
+	// a non blocking file is read through the poller, close stops the read
+	n.f = os.NewFile(uintptr(fd), "fanotify")
+	go func() {
+		<-ctx.Done()
+		_ = n.f.Close()
+	}()
+	go n.read()
+	return nil
+}
+
+// mark adds the filesystem of the path p unless it is marked already.
+func (n *fanotify) mark(fd int, p string) error {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return err
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return err
+	}
+	n.roots = append(n.roots, fanotifyRoot{path: p, real: real})
+
+	var st unix.Statfs_t
+	if err := unix.Statfs(real, &st); err != nil {
+		return err
+	}
+	if _, ok := n.mounts[st.Fsid.Val]; ok {
+		return nil
+	}
+
+	if err := unix.FanotifyMark(fd, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, fanotifyMask, unix.AT_FDCWD, real); err != nil {
+		return fmt.Errorf("fanotify mark %s: %w", real, err)
+	}
+	mfd, err := unix.Open(real, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	n.mounts[st.Fsid.Val] = mfd
+	logger.Debug().Str("path", real).Msg("fanotify filesystem marked")
+	return nil
+}
+
+func (n *fanotify) closeMounts() {
+	for _, fd := range n.mounts {
+		_ = unix.Close(fd)
+	}
+}
+
+func (n *fanotify) read() {
+	defer n.closeMounts()
+
+	buf := make([]byte, 64*1024)
+	for {
+		size, err := n.f.Read(buf)
+		if err != nil {
+			if n.ctx.Err() == nil && !errors.Is(err, os.ErrClosed) {
+				n.errors(fmt.Errorf("fanotify read: %w", err))
+			}
+			return
+		}
+		n.parse(buf[:size])
+	}
+}
+
+// parse sends the events of a read, every event is the metadata followed by
+// the info records.
+func (n *fanotify) parse(b []byte) {
+	metaLen := int(unsafe.Sizeof(unix.FanotifyEventMetadata{}))
+	for len(b) >= metaLen {
+		meta := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&b[0]))
+		if meta.Vers != unix.FANOTIFY_METADATA_VERSION {
+			logger.Error().Int("version", int(meta.Vers)).Msg("fanotify metadata version mismatch")
+			return
+		}
+		size := int(meta.Event_len)
+		if size < metaLen || size > len(b) {
+			return
+		}
+
+		if meta.Mask&unix.FAN_Q_OVERFLOW > 0 {
+			n.errors(fsnotify.ErrEventOverflow)
+		} else {
+			n.event(meta.Mask, b[meta.Metadata_len:size])
+		}
+		b = b[size:]
+	}
+}
+
+// event sends the change of mask reported by the folder handle and name of the
+// info record.
+func (n *fanotify) event(mask uint64, info []byte) {
+	// the cached paths below a moved or removed folder are stale, a folder
+	// moved in from outside the watched paths too
+	if mask&unix.FAN_ONDIR > 0 && mask&(unix.FAN_MOVED_FROM|unix.FAN_DELETE) > 0 {
+		n.dirs = make(map[string]string)
+	}
+
+	for len(info) >= 4 {
+		size := int(*(*uint16)(unsafe.Pointer(&info[2])))
+		if size < 4 || size > len(info) {
+			return
+		}
+		if info[0] == unix.FAN_EVENT_INFO_TYPE_DFID_NAME {
+			if name, ok := n.name(info[4:size]); ok {
+				n.send(mask, name)
+			}
+			return
+		}
+		info = info[size:]
+	}
+}
+
+// name returns the path of a fanotify_event_info_fid record, the filesystem
+// id and the folder handle followed by the name.
+func (n *fanotify) name(rec []byte) (string, bool) {
+	if len(rec) < 16 {
+		return "", false
+	}
+	fsid := [2]int32{*(*int32)(unsafe.Pointer(&rec[0])), *(*int32)(unsafe.Pointer(&rec[4]))}
+	handleLen := int(*(*uint32)(unsafe.Pointer(&rec[8])))
+	handleType := *(*int32)(unsafe.Pointer(&rec[12]))
+	if 16+handleLen > len(rec) {
+		return "", false
+	}
+
+	dir, ok := n.dir(fsid, handleType, rec[:16+handleLen])
+	if !ok {
+		return "", false
+	}
+	name := rec[16+handleLen:]
+	if i := strings.IndexByte(string(name), 0); i >= 0 {
+		name = name[:i]
+	}
+	if len(name) == 0 || string(name) == "." {
+		return "", false
+	}
+	return filepath.Join(dir, string(name)), true
+}
+
+// dir returns the watched path of the folder handle, it reports false for a
+// folder outside the watched paths or removed since.
+func (n *fanotify) dir(fsid [2]int32, handleType int32, rec []byte) (string, bool) {
+	key := string(rec)
+	if p, ok := n.dirs[key]; ok {
+		return p, p != ""
+	}
+	mfd, ok := n.mounts[fsid]
+	if !ok {
+		return "", false
+	}
+
+	fd, err := unix.OpenByHandleAt(mfd, unix.NewFileHandle(handleType, rec[16:]), unix.O_PATH|unix.O_CLOEXEC)
+	if err != nil {
+		return "", false
+	}
+	real, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+	_ = unix.Close(fd)
+	if err != nil {
+		return "", false
+	}
+
+	p := n.watched(real)
+	if len(n.dirs) >= maxCachedDirs {
+		n.dirs = make(map[string]string)
+	}
+	n.dirs[key] = p
+	return p, p != ""
+}
+
+// watched returns the real path as path below a watched path, empty when it
+// is not watched.
+func (n *fanotify) watched(real string) string {
+	for _, r := range n.roots {
+		if real == r.real {
+			return r.path
+		}
+		prefix := strings.TrimSuffix(r.real, string(filepath.Separator)) + string(filepath.Separator)
+		if strings.HasPrefix(real, prefix) {
+			return filepath.Join(r.path, real[len(prefix):])
+		}
+	}
+	return ""
+}
+
+// send converts the change of mask to fsnotify events. The kernel merges the
+// changes of a name, when it appeared and disappeared the current state wins.
+func (n *fanotify) send(mask uint64, name string) {
+	appeared := mask&(unix.FAN_CREATE|unix.FAN_MOVED_TO) > 0
+	gone := mask&(unix.FAN_MOVED_FROM|unix.FAN_DELETE) > 0
+	if appeared && gone {
+		_, err := os.Lstat(name)
+		appeared, gone = err == nil, err != nil
+	}
+
+	var ops []fsnotify.Op
+	switch {
+	case gone && mask&unix.FAN_MOVED_FROM > 0:
+		ops = append(ops, fsnotify.Rename)
+	case gone:
+		ops = append(ops, fsnotify.Remove)
+	case appeared:
+		ops = append(ops, fsnotify.Create)
+	}
+	if !gone && mask&unix.FAN_CLOSE_WRITE > 0 {
+		ops = append(ops, fsnotify.Write)
+	}
+
+	for _, op := range ops {
+		select {
+		case n.events <- fsnotify.Event{Name: name, Op: op}:
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
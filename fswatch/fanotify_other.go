@@ -0,0 +1,15 @@
+//go:build !linux
+
+package fswatch
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchMounts is not supported, fanotify is Linux only.
+func watchMounts(ctx context.Context, paths []string, events chan<- fsnotify.Event, errs func(error)) error {
+	return errors.New("fanotify is only supported on Linux")
+}
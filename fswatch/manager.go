@@ -0,0 +1,146 @@
+package fswatch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/hinha/watchgo/logger"
+)
+
+// watchManager keeps a watch on every folder below the watched paths. A
+// created folder is watched at once, the watches of a removed or renamed
+// folder are dropped. The watched folders are tracked so a folder is never
+// added twice. Without watcher the whole mounts are watched by fanotify, add
+// only lists the files. A path which reached the watch limit is polled, the
+// folders below it are not watched anymore.
+type watchManager struct {
+	w *fsnotify.Watcher
+
+	mu      sync.Mutex
+	watched map[string]bool
+	polled  map[string]bool
+}
+
+func newWatchManager(w *fsnotify.Watcher) *watchManager {
+	return &watchManager{w: w, watched: make(map[string]bool), polled: make(map[string]bool)}
+}
+
+// add watches root and every folder below it which is not watched yet. It
+// returns the files found, they may have been created before the watch. A
+// folder which fails is skipped, only a failed root and the watch limit are
+// returned.
+func (m *watchManager) add(root string) ([]string, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	root = filepath.Clean(root)
+	var files []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// removed while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if path == root {
+				return err
+			}
+			m.skip(path, err)
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+			return nil
+		}
+		if !info.IsDir() || m.w == nil {
+			return nil
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.isPolled(path) {
+			return filepath.SkipDir
+		}
+		if m.watched[path] {
+			return nil
+		}
+		if err := m.w.Add(path); err != nil {
+			// the watch limit applies to every folder
+			if path == root || errors.Is(err, syscall.ENOSPC) {
+				return err
+			}
+			m.skip(path, err)
+			return filepath.SkipDir
+		}
+		m.watched[path] = true
+		return nil
+	})
+	return files, err
+}
+
+// skip logs the folder path which can not be watched, the walk goes on with
+// the other folders.
+func (m *watchManager) skip(path string, err error) {
+	metrics.Add("errors", 1)
+	logger.Error().Str("path", path).Err(err).Msg("watch folder")
+}
+
+// drop removes the watches of the folder name and the folders below it. A
+// removed folder lost its watch already, a renamed one keeps it otherwise.
+func (m *watchManager) drop(name string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.watched[name] {
+		return
+	}
+
+	prefix := name + string(filepath.Separator)
+	for path := range m.watched {
+		if path != name && !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		delete(m.watched, path)
+		_ = m.w.Remove(path)
+	}
+	logger.Debug().Str("path", name).Msg("watch removed")
+}
+
+// poll drops the watches of the path root, the folders below it are not
+// watched anymore. It reports false when root is polled already.
+func (m *watchManager) poll(root string) bool {
+	if m == nil {
+		return false
+	}
+
+	root = filepath.Clean(root)
+	m.mu.Lock()
+	if m.polled[root] {
+		m.mu.Unlock()
+		return false
+	}
+	m.polled[root] = true
+	m.mu.Unlock()
+
+	m.drop(root)
+	return true
+}
+
+// isPolled reports whether path is below a polled path, m.mu is held.
+func (m *watchManager) isPolled(path string) bool {
+	for root := range m.polled {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
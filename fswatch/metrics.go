@@ -0,0 +1,8 @@
+package fswatch
+
+import "expvar"
+
+// metrics of the watcher, published by expvar as "watcher": the watcher
+// errors, the event queue overflows, the rescans and the paths polled since
+// they reached the watch limit.
+var metrics = expvar.NewMap("watcher")
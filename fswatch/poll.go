@@ -0,0 +1,132 @@
+package fswatch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/logger"
+)
+
+// modePoll is the mode of a path scanned for changes instead of watched.
+const modePoll = "poll"
+
+// defaultPollInterval seconds between two scans of a polled path.
+const defaultPollInterval = 60
+
+// fileState is a file of a scan.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// poller scans a path which filesystem does not report events, NFS, SMB or
+// FUSE, and sends the changes since the last scan as events.
+type poller struct {
+	root   string
+	events chan<- fsnotify.Event
+	// files of the last scan, nil until a scan succeeded
+	files map[string]fileState
+}
+
+// poll scans the path p before the sync and then every interval, the changes
+// are sent to the events of w.
+func (w *FSWatcher) poll(ctx context.Context, p config.PathConfig) {
+	interval := p.Interval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+
+	pl := &poller{root: p.Path, events: w.Events}
+	files, err := pl.scan()
+	if err != nil {
+		logger.Error().Str("path", p.Path).Err(err).Msg("poll path")
+	}
+	pl.files = files
+	logger.Debug().Str("path", p.Path).Int("interval", interval).Msg("path polled")
+
+	go pl.run(ctx, time.Duration(interval)*time.Second)
+}
+
+func (p *poller) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			files, err := p.scan()
+			if err != nil {
+				logger.Error().Str("path", p.root).Err(err).Msg("poll path")
+				continue
+			}
+			if p.files != nil {
+				p.diff(ctx, files)
+			}
+			p.files = files
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// scan returns the regular files below root. A folder which can not be read
+// fails the scan, its files would be reported as removed otherwise.
+func (p *poller) scan() (map[string]fileState, error) {
+	files := make(map[string]fileState)
+	err := filepath.Walk(p.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// removed while scanning, an unmounted root fails
+			if os.IsNotExist(err) && path != p.root {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files[path] = fileState{size: info.Size(), modTime: info.ModTime()}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// diff sends a create for the new files, a write for the files which size or
+// modification time changed and a remove for the files gone since the last
+// scan. A renamed file is removed and created.
+func (p *poller) diff(ctx context.Context, files map[string]fileState) {
+	for name := range p.files {
+		if _, ok := files[name]; !ok && !p.send(ctx, name, fsnotify.Remove) {
+			return
+		}
+	}
+	for name, f := range files {
+		old, ok := p.files[name]
+		switch {
+		case !ok:
+			if !p.send(ctx, name, fsnotify.Create) {
+				return
+			}
+		case old.size != f.size || !old.modTime.Equal(f.modTime):
+			if !p.send(ctx, name, fsnotify.Write) {
+				return
+			}
+		}
+	}
+}
+
+// send reports false when ctx is done.
+func (p *poller) send(ctx context.Context, name string, op fsnotify.Op) bool {
+	select {
+	case p.events <- fsnotify.Event{Name: name, Op: op}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -13,35 +13,48 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 
 	"github.com/hinha/watchgo/config"
 	"github.com/hinha/watchgo/core"
+	"github.com/hinha/watchgo/index"
 	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/storage"
 	"github.com/hinha/watchgo/utils"
 )
 
 // intervalDuration sync every 30 minutes.
 var intervalDuration = 30 * time.Minute
 
-type FSWatcher struct {
-	w      *fsnotify.Watcher
-	Events chan fsnotify.Event
+// syncFull is the sync mode hashing every file on every sync.
+const syncFull = "full"
+
+// defaultScrubInterval hours between two scrubs of an incremental sync.
+const defaultScrubInterval = 7 * 24
 
-	syncDone chan struct{}
-	image    *core.Image
-	file     *core.File
+type FSWatcher struct {
+	w *fsnotify.Watcher
+	// Events is the channel of the processed events, the fanotify backend
+	// sends to it.
+	Events       chan fsnotify.Event
+	Destinations []*core.Destination
+	// Index keeps the sums of the files, a sync only hashes changed files.
+	Index *index.Index
+
+	ctx     context.Context
+	watches *watchManager
+	// syncMu serializes the syncs, rescan holds the paths of the next rescan
+	syncMu sync.Mutex
+	mu     sync.Mutex
+	rescan map[string]bool
 }
 
 func janitor(ctx context.Context, w *FSWatcher, interval time.Duration) {
-	w.syncDone = make(chan struct{})
-	defer close(w.syncDone)
-
 	startInterval := interval.Seconds() + intervalDuration.Seconds()
 	done := make(chan bool)
 	ticker := time.NewTicker(time.Duration(startInterval) * time.Second)
@@ -55,9 +68,16 @@ func janitor(ctx context.Context, w *FSWatcher, interval time.Duration) {
 			ticker.Stop()
 
 			starTime := time.Now()
-			for i, p := range config.FileSystemCfg.Paths {
-				w.syncFile(p, i)
+			w.syncMu.Lock()
+			full := w.scrub()
+			for i, p := range config.FileSystemCfg.PathList() {
+				w.syncFile(p, i, full)
+			}
+			if full {
+				w.scrubbed(starTime)
 			}
+			w.collect()
+			w.syncMu.Unlock()
 
 			// reset interval
 			ticker = time.NewTicker(time.Duration(time.Since(starTime).Seconds()+intervalDuration.Seconds()) * time.Second)
@@ -70,109 +90,235 @@ func janitor(ctx context.Context, w *FSWatcher, interval time.Duration) {
 
 func (w *FSWatcher) FSWatcherStart(ctx context.Context, watch *fsnotify.Watcher) {
 	w.w = watch
+	w.ctx = ctx
+
+	// watch before the sync, the events are drained while it runs, so a file
+	// changed during the sync is not missed
+	var watched []string
+	for _, p := range config.FileSystemCfg.Paths {
+		if p.Mode == modePoll {
+			w.poll(ctx, p)
+			continue
+		}
+		watched = append(watched, p.Path)
+	}
 
-	w.syncDone = make(chan struct{})
-	defer close(w.syncDone)
-
-	builder := core.NewBuilder()
-	w.image = core.NewImageReader(builder)
-	w.file = core.NewFileReader(builder)
+	// the manager is set before the first event can arrive
+	w.watches = newWatchManager(watch)
+	if config.FileSystemCfg.Events.Fanotify {
+		w.watches = newWatchManager(nil)
+		if err := watchMounts(ctx, watched, w.Events, w.Error); err != nil {
+			logger.Error().Err(err).Msg("fanotify unavailable, watching with inotify")
+			w.watches = newWatchManager(watch)
+		} else {
+			logger.Info(0).Msg("watching the whole mounts with fanotify")
+		}
+	}
+	for _, p := range watched {
+		if w.watches.w == nil {
+			// fanotify
+			break
+		}
+		if _, err := w.watches.add(p); err != nil {
+			// synced below
+			metrics.Add("errors", 1)
+			w.degrade(p, err)
+		}
+	}
 
 	starTime := time.Now()
-	for i, p := range config.FileSystemCfg.Paths {
-		w.syncFile(p, i)
-		//go watcherInit(w.FChan, p)
-		go watcherInit(ctx, w.w, p)
+	w.syncMu.Lock()
+	full := w.scrub()
+	for i, p := range config.FileSystemCfg.PathList() {
+		w.syncFile(p, i, full)
 	}
+	if full {
+		w.scrubbed(starTime)
+	}
+	w.syncMu.Unlock()
 	logger.Debug().Dur("duration", time.Since(starTime)).Msg("scanning complete")
 	go janitor(ctx, w, time.Since(starTime))
 }
 
-func (w *FSWatcher) FSWatcherStop() {
-	if err := w.w.Close(); err != nil {
-		log.Fatal(err)
+// Error handles an error of the watcher. An overflow of the event queue lost
+// events, the watched paths are rescanned.
+func (w *FSWatcher) Error(err error) {
+	metrics.Add("errors", 1)
+	if !errors.Is(err, fsnotify.ErrEventOverflow) {
+		logger.Error().Err(err).Msg("watcher")
+		return
+	}
+
+	metrics.Add("overflows", 1)
+	logger.Error().Err(err).Msg("event queue overflow, rescan the watched paths")
+	var paths []string
+	for _, p := range config.FileSystemCfg.Paths {
+		if p.Mode != modePoll {
+			paths = append(paths, p.Path)
+		}
 	}
+	w.Rescan(paths...)
 }
 
-// watcherInit.
-func watcherInit(ctx context.Context, w *fsnotify.Watcher, path string) {
-	dirs := func(root string) ([]string, error) {
-		var folders []string
-		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-			if info.IsDir() {
-				folders = append(folders, path)
+// Rescan syncs paths after their events were lost, the folders created
+// meanwhile are watched first. The paths of rescans requested while one waits
+// for a running sync are synced together.
+func (w *FSWatcher) Rescan(paths ...string) {
+	w.mu.Lock()
+	queued := w.rescan != nil
+	if !queued {
+		w.rescan = make(map[string]bool)
+	}
+	for _, p := range paths {
+		w.rescan[filepath.Clean(p)] = true
+	}
+	w.mu.Unlock()
+	if queued {
+		return
+	}
+
+	go func() {
+		w.syncMu.Lock()
+		defer w.syncMu.Unlock()
+
+		w.mu.Lock()
+		rescan := w.rescan
+		w.rescan = nil
+		w.mu.Unlock()
+
+		metrics.Add("rescans", 1)
+		for i, p := range config.FileSystemCfg.PathList() {
+			if rescan[filepath.Clean(p)] {
+				logger.Info(0).Str("path", p).Msg("rescan")
+				if _, err := w.watches.add(p); err != nil {
+					metrics.Add("errors", 1)
+					w.degrade(p, err)
+				}
+				w.syncFile(p, i, false)
 			}
-			return nil
-		})
-		return folders, err
+		}
+	}()
+}
+
+// degrade polls the path root which can not be watched, the inotify watch
+// limit is reached or a folder failed, its watches are dropped. It reports
+// false when root is polled already.
+func (w *FSWatcher) degrade(root string, err error) bool {
+	root = filepath.Clean(root)
+	if !w.watches.poll(root) {
+		return false
 	}
 
-	list, err := dirs(path)
-	if err != nil {
-		log.Fatalf("walk dir %s", err)
+	metrics.Add("polled_paths", 1)
+	if errors.Is(err, syscall.ENOSPC) {
+		logger.Warn().Str("path", root).Msg("inotify watch limit reached, the path is polled, raise fs.inotify.max_user_watches to watch it")
+	} else {
+		logger.Warn().Str("path", root).Err(err).Msg("watch path failed, the path is polled")
 	}
+	w.poll(w.ctx, config.PathConfig{Path: root, Mode: modePoll})
+	return true
+}
 
-	// sync dir never stop initial watcher
-	go func() {
-		interval := 3 * time.Second
-		ticker := time.NewTicker(interval)
-		for {
-			select {
-			case <-ticker.C:
-				ticker.Stop()
+func (w *FSWatcher) FSWatcherStop() {
+	if err := w.w.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
 
-				list, err := dirs(path)
-				if err != nil {
-					ticker.Stop()
-					return
-				}
+// scrub reports whether the next sync hashes every file instead of reusing
+// the sums of unchanged files recorded in the index.
+func (w *FSWatcher) scrub() bool {
+	cfg := config.FileSystemCfg.Sync
+	if w.Index == nil || cfg.Mode == syncFull {
+		return true
+	}
 
-				for _, f := range list {
-					if err := w.Add(f); err != nil {
-						log.Fatalf("watch path %s error: %s\n", path, err)
-					}
-				}
+	interval := cfg.ScrubInterval
+	if interval <= 0 {
+		interval = defaultScrubInterval
+	}
+	return time.Since(w.Index.LastScrub()) >= time.Duration(interval)*time.Hour
+}
 
-				// reset interval
-				ticker = time.NewTicker(interval)
-			case <-ctx.Done():
-				ticker.Stop()
-				return
-			}
+// scrubbed records the start of a sync which hashed every file.
+func (w *FSWatcher) scrubbed(starTime time.Time) {
+	if err := w.Index.PutLastScrub(starTime); err != nil {
+		logger.Error().Err(err).Msg("index scrub")
+	}
+	logger.Debug().Dur("duration", time.Since(starTime)).Msg("scrub complete")
+}
+
+// collect removes expired trash and unreferenced data of the destinations,
+// e.g. chunks.
+func (w *FSWatcher) collect() {
+	for _, d := range w.Destinations {
+		if !d.Available() {
+			continue
+		}
+		store, err := d.Storage()
+		if err != nil {
+			continue
 		}
-	}()
 
-	for _, f := range list {
-		if err := w.Add(f); err != nil {
-			log.Fatalf("watch path %s error: %s\n", path, err)
+		starTime := time.Now()
+		if err := d.EmptyTrash(); err != nil {
+			logger.Error().Str("destination", d.Name).Err(err).Msg("empty trash of backup destination")
 		}
+		if err := storage.Collect(store); err != nil {
+			logger.Error().Str("destination", d.Name).Err(err).Msg("collect backup destination")
+			continue
+		}
+		logger.Debug().Str("destination", d.Name).Dur("duration", time.Since(starTime)).Msg("collect complete")
 	}
 }
 
 // A resultSync is the product of reading and summing a file using MD5.
+// recorded is set for a backup with the sum of its source in the metadata.
 type resultSync struct {
-	path string
-	sum  string
-	err  error
+	path     string
+	sum      string
+	err      error
+	recorded bool
 }
 
-func (w *FSWatcher) syncFile(path string, index int) {
-	drive := make(chan resultSync)
-	driveErr := make(chan error, 1)
-	defer close(driveErr)
-	w.hardDrive(drive, driveErr)
+// driveIndex are the backups of a destination by source sum. A backup without
+// a recorded sum may have been compressed, it is matched by its base name.
+// thumbs are the names of the thumbnails when they are enabled.
+type driveIndex struct {
+	sums   map[string]string
+	legacy map[string]bool
+	thumbs map[string]bool
+}
 
-	mDrive := make(map[string]string)
-	for r := range drive {
-		if r.err != nil {
-			logger.Error().Err(r.err).Msg("hard drive")
+// syncFile backs up the files of the watched root path which are missing in
+// a destination. A full sync hashes every file, otherwise the sums recorded
+// in the index are used for unchanged files.
+func (w *FSWatcher) syncFile(path string, index int, full bool) {
+	// the walks of this sync stop once it returns
+	done := make(chan struct{})
+	defer close(done)
+
+	drives := make(map[*core.Destination]driveIndex)
+	for _, d := range w.Destinations {
+		if !d.Available() {
+			logger.Debug().Str("destination", d.Name).Msg("skip sync of failing backup destination")
 			continue
 		}
-		mDrive[r.sum] = r.path
-	}
 
-	if err := <-driveErr; err != nil {
-		logger.Error().Err(err).Msg("fatal hard drive")
+		store, err := d.Storage()
+		if err != nil {
+			logger.Error().Str("destination", d.Name).Err(err).Msg("open backup destination")
+			continue
+		}
+
+		mDrive, err := w.hardDrive(done, store, full)
+		if err != nil {
+			logger.Error().Str("destination", d.Name).Err(err).Msg("fatal hard drive")
+			continue
+		}
+		drives[d] = mDrive
+	}
+	if len(drives) == 0 {
 		return
 	}
 
@@ -180,44 +326,34 @@ func (w *FSWatcher) syncFile(path string, index int) {
 	localErr := make(chan error, 1)
 	defer close(localErr)
 
-	w.localDrive(path, index, local, localErr)
+	w.localDrive(done, path, index, full, local, localErr)
+
+	// wait for the workers, done is closed once the sync returns
+	var wg sync.WaitGroup
+	defer wg.Wait()
 	for work := 0; work < config.General.Worker; work++ {
+		wg.Add(1)
 		go func(id int, jobs <-chan resultSync) {
+			defer wg.Done()
 			for r := range jobs {
 				if r.err != nil {
 					logger.Error().Err(r.err).Msg("local drive")
 					continue
 				}
 
-				if _, ok := mDrive[r.sum]; ok {
-					continue
-				} else {
-					var countDuplicate int
-					for _, v := range mDrive {
-						if filepath.Base(v) == filepath.Base(r.path) {
-							countDuplicate++
-						}
-					}
-
-					if countDuplicate >= 1 {
-						continue
-					}
-				}
-
-				reImage, err := regexp.Compile(core.Regexp())
-				if err != nil {
-					continue
-				}
-
 				subPath := strings.SplitAfter(r.path, path)
-				if reImage.MatchString(r.path) {
-					if err := w.image.Open(r.path, subPath); err != nil {
+				for d, mDrive := range drives {
+					if !d.Match(r.path) {
 						continue
 					}
-				} else {
-					if err := w.file.Open(r.path, subPath); err != nil {
+					if backedUp(mDrive, r) {
+						thumbnail(d, mDrive, r, subPath)
 						continue
 					}
+
+					if err := d.Backup(r.path, subPath); err != nil {
+						logger.Error().Str("destination", d.Name).Str("path", r.path).Err(err).Msg("sync backup destination")
+					}
 				}
 			}
 		}(work, local)
@@ -227,21 +363,139 @@ func (w *FSWatcher) syncFile(path string, index int) {
 		logger.Error().Err(err).Msg("fatal local drive")
 		return
 	}
+	if err := w.Index.Prune(path); err != nil {
+		logger.Error().Err(err).Msg("prune index")
+	}
 }
 
-func (w *FSWatcher) hardDrive(c chan resultSync, errc chan error) {
-	dirPath := path.Join(config.FileSystemCfg.Backup.HardDrivePath, config.GetStaticBackupFolder())
-	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
-		_ = os.Mkdir(dirPath, 0700)
+// thumbnail regenerates the missing thumbnail of a backed up file r.
+func thumbnail(d *core.Destination, mDrive driveIndex, r resultSync, subPath []string) {
+	name, ok := mDrive.sums[r.sum]
+	if mDrive.thumbs == nil || !ok || mDrive.thumbs[storage.ThumbName(name)] || !d.Thumbnailable(r.path) {
+		return
+	}
+	if err := d.Thumbnail(r.path, name, r.sum); err != nil {
+		logger.Error().Str("destination", d.Name).Str("path", r.path).Err(err).Msg("sync thumbnail")
+	}
+}
+
+// backedUp reports whether the local file r has a copy in mDrive, either with
+// the same sum or a backup without recorded sum with the same file name.
+func backedUp(mDrive driveIndex, r resultSync) bool {
+	if _, ok := mDrive.sums[r.sum]; ok {
+		return true
+	}
+	return mDrive.legacy[filepath.Base(r.path)]
+}
+
+// hardDrive returns the sums of every object of the destination.
+func (w *FSWatcher) hardDrive(done <-chan struct{}, store storage.Storage, full bool) (driveIndex, error) {
+	drive := make(chan resultSync)
+	driveErr := make(chan error, 1)
+	defer close(driveErr)
+	go walkStorage(done, drive, driveErr, store, w.Index, full)
+
+	mDrive := driveIndex{sums: make(map[string]string), legacy: make(map[string]bool)}
+	for r := range drive {
+		if r.err != nil {
+			logger.Error().Str("storage", store.String()).Err(r.err).Msg("hard drive")
+			continue
+		}
+		mDrive.sums[r.sum] = r.path
+		if !r.recorded {
+			mDrive.legacy[path.Base(r.path)] = true
+		}
 	}
-	go walkDir(w.syncDone, c, errc, dirPath, 0, false)
+	if err := <-driveErr; err != nil {
+		return mDrive, err
+	}
+
+	if !config.FileSystemCfg.Thumbnails.Enabled {
+		return mDrive, nil
+	}
+	mDrive.thumbs = make(map[string]bool)
+	err := store.List(storage.ThumbsFolder, func(obj storage.Object) error {
+		mDrive.thumbs[obj.Name] = true
+		return nil
+	})
+	return mDrive, err
 }
 
-func (w *FSWatcher) localDrive(path string, index int, c chan resultSync, errc chan error) {
-	go walkDir(w.syncDone, c, errc, path, index, true)
+func (w *FSWatcher) localDrive(done <-chan struct{}, path string, index int, full bool, c chan resultSync, errc chan error) {
+	go walkDir(done, c, errc, path, index, true, w.Index, full)
+}
+
+// walkStorage sums every object of the backup destination, the sum recorded
+// in the object metadata or, unless full, in idx is used when there is one.
+func walkStorage(done <-chan struct{}, c chan resultSync, errc chan error, store storage.Storage, idx *index.Index, full bool) {
+	var wg sync.WaitGroup
+	err := store.List("", func(obj storage.Object) error {
+		if storage.IsDerived(obj.Name) || storage.IsTrash(obj.Name) {
+			return nil
+		}
+		if sum := obj.Sum(); sum != "" {
+			select {
+			case c <- resultSync{obj.Name, sum, nil, true}:
+				return nil
+			case <-done:
+				return errors.New("walk canceled")
+			}
+		}
+		if sum, ok := idx.ObjectSum(store.String(), obj); ok && !full {
+			select {
+			case c <- resultSync{obj.Name, sum, nil, false}:
+				return nil
+			case <-done:
+				return errors.New("walk canceled")
+			}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			rc, err := store.Open(obj.Name)
+			if err != nil {
+				c <- resultSync{"", "", err, false}
+				return
+			}
+			defer rc.Close()
+
+			hash := sha1.New()
+			_, err = io.Copy(hash, bufio.NewReader(rc))
+
+			sum := hex.EncodeToString(hash.Sum(nil))
+			if err == nil {
+				if err := idx.PutObjectSum(store.String(), obj, sum); err != nil {
+					logger.Error().Str("storage", store.String()).Err(err).Msg("index object")
+				}
+			}
+			select {
+			case c <- resultSync{obj.Name, sum, err, false}:
+			case <-done:
+			}
+		}()
+
+		// Abort the walk if done is closed.
+		select {
+		case <-done:
+			return errors.New("walk canceled")
+		default:
+			return nil
+		}
+	})
+
+	go func() {
+		wg.Wait()
+		close(c)
+	}()
+
+	errc <- err
 }
 
-func walkDir(done <-chan struct{}, c chan resultSync, errc chan error, path string, index int, runLocal bool) {
+// walkDir sums every file below path. Unless full, the sum recorded in idx is
+// used for a file which size and modification time did not change.
+func walkDir(done <-chan struct{}, c chan resultSync, errc chan error, path string, index int, runLocal bool, idx *index.Index, full bool) {
 	var wg sync.WaitGroup
 	err := filepath.Walk(path, func(path string, info fs.FileInfo, err error) error {
 		if utils.IgnoreExtension(path) {
@@ -258,7 +512,7 @@ func walkDir(done <-chan struct{}, c chan resultSync, errc chan error, path stri
 
 		if !info.IsDir() {
 			if runLocal {
-				_, after, _ := strings.Cut(path, config.FileSystemCfg.Paths[index])
+				_, after, _ := strings.Cut(path, config.FileSystemCfg.Paths[index].Path)
 				// start from .Folder/foo
 				ok, _ := utils.IsHiddenFile(after[1:])
 				if ok {
@@ -267,34 +521,49 @@ func walkDir(done <-chan struct{}, c chan resultSync, errc chan error, path stri
 
 				size := utils.ByteSize(info.Size())
 				maxSize := utils.ByteSize(config.FileSystemCfg.MaxFileSize) * utils.MB
-				if size >= maxSize {
+				if size >= maxSize && !core.Transcodable(path, info.Size()) {
 					logger.Error().Str("path", path).Err(fmt.Errorf("size limit %s, of maximum %s", size.String(), maxSize.String())).Msg("local drive")
 					return nil
 				}
 			}
 
+			if sum, ok := idx.Sum(path, info, config.FileSystemCfg.Sync.Inode); ok && !full {
+				select {
+				case c <- resultSync{path, sum, nil, false}:
+				case <-done:
+				}
+				return nil
+			}
+
 			wg.Add(1)
 			go func() {
+				defer wg.Done()
 				fos, err := os.Open(path)
-				defer func() {
-					_ = fos.Close()
-				}()
 				if err != nil {
-					c <- resultSync{"", "", err}
+					select {
+					case c <- resultSync{"", "", err, false}:
+					case <-done:
+					}
 					return
 				}
+				defer func() {
+					_ = fos.Close()
+				}()
 				reader := bufio.NewReader(fos)
 
 				hash := sha1.New()
-				_, _ = io.Copy(hash, reader)
+				_, err = io.Copy(hash, reader)
 
-				sum := hash.Sum(nil)
+				sum := hex.EncodeToString(hash.Sum(nil))
+				if err == nil {
+					if err := idx.PutSum(path, info, sum); err != nil {
+						logger.Error().Str("path", path).Err(err).Msg("index file")
+					}
+				}
 				select {
-				case c <- resultSync{path, hex.EncodeToString(sum[:]), err}:
+				case c <- resultSync{path, sum, err, false}:
 				case <-done:
 				}
-
-				wg.Done()
 			}()
 		}
 
@@ -0,0 +1,315 @@
+// Package index keeps a persistent record of the watched files and their
+// backups. A sync only hashes a file whose size or modification time changed
+// since it was recorded.
+package index
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/hinha/watchgo/storage"
+)
+
+var (
+	filesBucket   = []byte("files")
+	objectsBucket = []byte("objects")
+	stateBucket   = []byte("state")
+)
+
+// lastScrubKey is the time of the last sync which hashed every file.
+var lastScrubKey = []byte("last_scrub")
+
+// Entry is a watched file with its sum and the backups of it by destination.
+type Entry struct {
+	Path    string            `json:"path"`
+	Size    int64             `json:"size"`
+	ModTime time.Time         `json:"mtime"`
+	Inode   uint64            `json:"inode,omitempty"`
+	Sum     string            `json:"sum"`
+	Backups map[string]Backup `json:"backups,omitempty"`
+}
+
+// Backup is the copy of a file in a destination.
+type Backup struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+}
+
+// object is the sum of a backup which has no sum in its metadata.
+type object struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Sum     string    `json:"sum"`
+}
+
+// Index is the index database. A nil Index is valid, it records nothing and
+// never has a sum, so a sync hashes every file.
+type Index struct {
+	db *bolt.DB
+}
+
+// Open opens the index at file, it is created when it does not exist. An
+// empty file disables the index and returns nil.
+func Open(file string) (*Index, error) {
+	if file == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{filesBucket, objectsBucket, stateBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &Index{db: db}, nil
+}
+
+// Close closes the database.
+func (x *Index) Close() error {
+	if x == nil {
+		return nil
+	}
+	return x.db.Close()
+}
+
+// Get returns the entry of the local file lPath.
+func (x *Index) Get(lPath string) (Entry, bool, error) {
+	var e Entry
+	if x == nil {
+		return e, false, nil
+	}
+
+	var found bool
+	err := x.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(filesBucket).Get([]byte(filepath.Clean(lPath)))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &e)
+	})
+	return e, found, err
+}
+
+// Sum returns the recorded sum of lPath when its size and modification time,
+// and with checkInode its inode, did not change.
+func (x *Index) Sum(lPath string, fi fs.FileInfo, checkInode bool) (string, bool) {
+	e, ok, err := x.Get(lPath)
+	if err != nil || !ok || e.Size != fi.Size() || !e.ModTime.Equal(fi.ModTime()) {
+		return "", false
+	}
+	if checkInode && e.Inode != inode(fi) {
+		return "", false
+	}
+	return e.Sum, e.Sum != ""
+}
+
+// PutSum records the sum of lPath. The backups of a file which content
+// changed are dropped, they hold the previous content.
+func (x *Index) PutSum(lPath string, fi fs.FileInfo, sum string) error {
+	return x.update(lPath, func(e *Entry) {
+		if e.Sum != sum {
+			e.Backups = nil
+		}
+		e.Size, e.ModTime, e.Inode, e.Sum = fi.Size(), fi.ModTime(), inode(fi), sum
+	})
+}
+
+// PutBackup records that lPath is backed up as name in the destination dest.
+func (x *Index) PutBackup(lPath, dest, name string, t time.Time) error {
+	return x.update(lPath, func(e *Entry) {
+		if e.Backups == nil {
+			e.Backups = make(map[string]Backup)
+		}
+		e.Backups[dest] = Backup{Name: name, Time: t}
+	})
+}
+
+// PutRenamed records that newPath, the renamed file oldPath, is backed up as
+// name in the destination dest. The size, modification time and sum of
+// oldPath are kept for newPath, a rename does not change them.
+func (x *Index) PutRenamed(oldPath, newPath, dest, name string, t time.Time) error {
+	old, ok, err := x.Get(oldPath)
+	if err != nil {
+		return err
+	}
+	return x.update(newPath, func(e *Entry) {
+		if ok {
+			e.Size, e.ModTime, e.Inode, e.Sum = old.Size, old.ModTime, old.Inode, old.Sum
+		}
+		if e.Backups == nil {
+			e.Backups = make(map[string]Backup)
+		}
+		e.Backups[dest] = Backup{Name: name, Time: t}
+	})
+}
+
+// update applies fn to the entry of lPath. Concurrent updates are batched in
+// a single transaction.
+func (x *Index) update(lPath string, fn func(e *Entry)) error {
+	if x == nil {
+		return nil
+	}
+
+	lPath = filepath.Clean(lPath)
+	return x.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket(filesBucket)
+		e := Entry{Path: lPath}
+		if data := b.Get([]byte(lPath)); data != nil {
+			if err := json.Unmarshal(data, &e); err != nil {
+				return err
+			}
+		}
+
+		fn(&e)
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(lPath), data)
+	})
+}
+
+// Walk calls fn for every entry below the folder root, every entry for an
+// empty root.
+func (x *Index) Walk(root string, fn func(Entry) error) error {
+	if x == nil {
+		return nil
+	}
+
+	prefix := []byte(root)
+	if root != "" {
+		prefix = []byte(filepath.Clean(root) + string(filepath.Separator))
+	}
+	return x.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(filesBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = c.Next() {
+			var e Entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Prune removes the entries below the folder root which file does not exist
+// anymore.
+func (x *Index) Prune(root string) error {
+	if x == nil {
+		return nil
+	}
+
+	var gone [][]byte
+	err := x.Walk(root, func(e Entry) error {
+		if _, err := os.Lstat(e.Path); errors.Is(err, fs.ErrNotExist) {
+			gone = append(gone, []byte(e.Path))
+		}
+		return nil
+	})
+	if err != nil || len(gone) == 0 {
+		return err
+	}
+	return x.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(filesBucket)
+		for _, k := range gone {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ObjectSum returns the recorded sum of the object of the storage store when
+// its size and modification time did not change.
+func (x *Index) ObjectSum(store string, obj storage.Object) (string, bool) {
+	if x == nil {
+		return "", false
+	}
+
+	var o object
+	err := x.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(objectsBucket).Bucket([]byte(store))
+		if b == nil {
+			return nil
+		}
+		if data := b.Get([]byte(obj.Name)); data != nil {
+			return json.Unmarshal(data, &o)
+		}
+		return nil
+	})
+	if err != nil || o.Sum == "" || o.Size != obj.Size || !o.ModTime.Equal(obj.ModTime) {
+		return "", false
+	}
+	return o.Sum, true
+}
+
+// PutObjectSum records the sum of the object of the storage store.
+func (x *Index) PutObjectSum(store string, obj storage.Object, sum string) error {
+	if x == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(object{Size: obj.Size, ModTime: obj.ModTime, Sum: sum})
+	if err != nil {
+		return err
+	}
+	return x.db.Batch(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(objectsBucket).CreateBucketIfNotExists([]byte(store))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(obj.Name), data)
+	})
+}
+
+// LastScrub returns the time of the last sync which hashed every file, zero
+// when there was none.
+func (x *Index) LastScrub() time.Time {
+	var t time.Time
+	if x == nil {
+		return t
+	}
+	_ = x.db.View(func(tx *bolt.Tx) error {
+		return t.UnmarshalText(tx.Bucket(stateBucket).Get(lastScrubKey))
+	})
+	return t
+}
+
+// PutLastScrub records the time of a sync which hashed every file.
+func (x *Index) PutLastScrub(t time.Time) error {
+	if x == nil {
+		return nil
+	}
+	data, err := t.MarshalText()
+	if err != nil {
+		return err
+	}
+	return x.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucket).Put(lastScrubKey, data)
+	})
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package index
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// inode returns the inode number of fi, zero when it is unknown.
+func inode(fi fs.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package index
+
+import "io/fs"
+
+// inode returns zero, the file index of Windows is not part of fi.
+func inode(fi fs.FileInfo) uint64 {
+	return 0
+}
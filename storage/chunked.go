@@ -0,0 +1,345 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chunksFolder keeps every unique chunk once as .chunks/<2 hex>/<sha256>.
+const chunksFolder = ".chunks"
+
+// collectGrace chunks younger than this are never collected, they may belong
+// to an upload whose manifest is not written yet.
+var collectGrace = time.Hour
+
+// Collector is implemented by destinations which need to remove data no
+// longer referenced by any object.
+type Collector interface {
+	Collect() error
+}
+
+// Unwrapper is implemented by destinations wrapping another one.
+type Unwrapper interface {
+	Unwrap() Storage
+}
+
+// Collect runs the garbage collection of store or of the destination it wraps.
+func Collect(store Storage) error {
+	for store != nil {
+		if collector, ok := store.(Collector); ok {
+			return collector.Collect()
+		}
+		unwrapper, ok := store.(Unwrapper)
+		if !ok {
+			return nil
+		}
+		store = unwrapper.Unwrap()
+	}
+	return nil
+}
+
+// manifest replaces the content of an object in a chunked repository.
+type manifest struct {
+	Version int      `json:"watchgo_manifest"`
+	Size    int64    `json:"size"`
+	Chunks  []string `json:"chunks"`
+	Meta    Metadata `json:"meta,omitempty"`
+}
+
+// Chunked is a deduplicating repository: files are split into content
+// defined chunks, each unique chunk is stored once and every object is a
+// manifest listing its chunks. Objects stored before the repository was
+// chunked are read as they are.
+type Chunked struct {
+	Storage
+
+	mu    sync.Mutex
+	known map[string]bool
+	// gc is held by Collect, a Put may deduplicate against a chunk it would
+	// delete otherwise
+	gc sync.RWMutex
+}
+
+// NewChunked wraps store with a chunked repository.
+func NewChunked(store Storage) *Chunked {
+	return &Chunked{Storage: store}
+}
+
+func (c *Chunked) Unwrap() Storage {
+	return c.Storage
+}
+
+func chunkName(id string) string {
+	return path.Join(chunksFolder, id[:2], id)
+}
+
+// loadKnown lists the stored chunks once, c.mu must be held.
+func (c *Chunked) loadKnown() error {
+	if c.known != nil {
+		return nil
+	}
+
+	known := make(map[string]bool)
+	err := c.Storage.List(chunksFolder, func(obj Object) error {
+		known[path.Base(obj.Name)] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.known = known
+	return nil
+}
+
+func (c *Chunked) stored(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.known[id]
+}
+
+func (c *Chunked) Put(name string, r io.Reader, meta Metadata) error {
+	c.gc.RLock()
+	defer c.gc.RUnlock()
+
+	c.mu.Lock()
+	err := c.loadKnown()
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	m := manifest{Version: 1, Meta: meta}
+	ch := newChunker(r)
+	for {
+		chunk, err := ch.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(chunk)
+		id := hex.EncodeToString(sum[:])
+		if !c.stored(id) {
+			if err := c.Storage.Put(chunkName(id), bytes.NewReader(chunk), nil); err != nil {
+				return err
+			}
+			c.mu.Lock()
+			c.known[id] = true
+			c.mu.Unlock()
+		}
+
+		m.Chunks = append(m.Chunks, id)
+		m.Size += int64(len(chunk))
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return c.Storage.Put(name, bytes.NewReader(data), meta)
+}
+
+// manifestMagic starts every encoded manifest, Version is its first field.
+var manifestMagic = []byte(`{"watchgo_manifest":`)
+
+// manifest reads the manifest of name, ok is false for a plain object.
+func (c *Chunked) manifest(name string) (m manifest, ok bool, err error) {
+	rc, err := c.Storage.Open(name)
+	if err != nil {
+		return manifest{}, false, err
+	}
+	defer rc.Close()
+
+	head := make([]byte, len(manifestMagic))
+	if _, err := io.ReadFull(rc, head); err != nil || !bytes.Equal(head, manifestMagic) {
+		return manifest{}, false, nil
+	}
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return manifest{}, false, err
+	}
+	if err := json.Unmarshal(append(head, data...), &m); err != nil {
+		return manifest{}, false, fmt.Errorf("manifest %s: %w", name, err)
+	}
+	return m, true, nil
+}
+
+func (c *Chunked) object(obj Object) (Object, error) {
+	m, ok, err := c.manifest(obj.Name)
+	if err != nil || !ok {
+		return obj, err
+	}
+	obj.Size = m.Size
+	obj.Metadata = m.Meta
+	return obj, nil
+}
+
+func (c *Chunked) Stat(name string) (Object, error) {
+	obj, err := c.Storage.Stat(name)
+	if err != nil {
+		return Object{}, err
+	}
+	return c.object(obj)
+}
+
+// List skips the chunks, only objects are listed.
+func (c *Chunked) List(prefix string, fn func(Object) error) error {
+	objs, err := c.objects(prefix)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		obj, err := c.object(obj)
+		if errors.Is(err, fs.ErrNotExist) {
+			// removed since it was listed
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objects returns the stored objects below prefix without the chunks. The
+// listing is done before a manifest is read, a destination may hold its only
+// connection while it lists.
+func (c *Chunked) objects(prefix string) ([]Object, error) {
+	var objs []Object
+	err := c.Storage.List(prefix, func(obj Object) error {
+		if !strings.HasPrefix(obj.Name, chunksFolder+"/") {
+			objs = append(objs, obj)
+		}
+		return nil
+	})
+	return objs, err
+}
+
+// Open returns the content of the chunks, every chunk is verified against its
+// sum while it is read.
+func (c *Chunked) Open(name string) (io.ReadCloser, error) {
+	m, ok, err := c.manifest(name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return c.Storage.Open(name)
+	}
+	return &chunkReader{store: c.Storage, chunks: m.Chunks}, nil
+}
+
+// Rename only moves the manifest, the chunks stay where they are.
+func (c *Chunked) Rename(oldName, newName string) error {
+	return Move(c.Storage, oldName, newName)
+}
+
+// Collect removes the chunks which are not referenced by any manifest,
+// revisions included. Puts wait for the collection.
+func (c *Chunked) Collect() error {
+	c.gc.Lock()
+	defer c.gc.Unlock()
+
+	start := time.Now()
+	used := make(map[string]bool)
+	objs, err := c.objects("")
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		m, ok, err := c.manifest(obj.Name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if ok {
+			for _, id := range m.Chunks {
+				used[id] = true
+			}
+		}
+	}
+
+	var unused []string
+	err = c.Storage.List(chunksFolder, func(obj Object) error {
+		if !used[path.Base(obj.Name)] && obj.ModTime.Before(start.Add(-collectGrace)) {
+			unused = append(unused, obj.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range unused {
+		if err := c.Storage.Delete(name); err != nil {
+			return err
+		}
+		delete(c.known, path.Base(name))
+	}
+	return nil
+}
+
+// chunkReader reads the chunks of a manifest one after the other.
+type chunkReader struct {
+	store  Storage
+	chunks []string
+	cur    *bytes.Reader
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for r.cur == nil || r.cur.Len() == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+
+		id := r.chunks[0]
+		r.chunks = r.chunks[1:]
+		data, err := r.read(id)
+		if err != nil {
+			return 0, err
+		}
+		r.cur = bytes.NewReader(data)
+	}
+	return r.cur.Read(p)
+}
+
+func (r *chunkReader) read(id string) ([]byte, error) {
+	rc, err := r.store.Open(chunkName(id))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != id {
+		return nil, fmt.Errorf("chunk %s is corrupted", id)
+	}
+	return data, nil
+}
+
+func (r *chunkReader) Close() error {
+	r.chunks, r.cur = nil, nil
+	return nil
+}
@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hinha/watchgo/config"
+)
+
+// chunks returns the chunks of data.
+func chunks(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	var out [][]byte
+	ch := newChunker(bytes.NewReader(data))
+	for {
+		chunk, err := ch.next()
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, chunk)
+	}
+}
+
+func chunkIDs(chunks [][]byte) map[string]bool {
+	ids := make(map[string]bool)
+	for _, chunk := range chunks {
+		sum := sha256.Sum256(chunk)
+		ids[hex.EncodeToString(sum[:])] = true
+	}
+	return ids
+}
+
+func TestChunker(t *testing.T) {
+	data := randomBytes(t, 16<<20)
+	got := chunks(t, data)
+
+	if !bytes.Equal(bytes.Join(got, nil), data) {
+		t.Fatal("chunks do not add up to the content")
+	}
+	for i, chunk := range got {
+		if len(chunk) > maxChunkSize {
+			t.Errorf("chunk %d of %d bytes exceeds the maximum", i, len(chunk))
+		}
+		if len(chunk) < minChunkSize && i < len(got)-1 {
+			t.Errorf("chunk %d of %d bytes is below the minimum", i, len(chunk))
+		}
+	}
+	if len(got) < 2 {
+		t.Fatalf("got %d chunks, want content defined boundaries", len(got))
+	}
+
+	again := chunks(t, data)
+	if len(again) != len(got) {
+		t.Fatal("chunk boundaries changed between runs")
+	}
+}
+
+func TestChunkerInsert(t *testing.T) {
+	data := randomBytes(t, 16<<20)
+	mid := len(data) / 2
+	edited := append(append(append([]byte{}, data[:mid]...), "inserted"...), data[mid:]...)
+
+	before, after := chunkIDs(chunks(t, data)), chunkIDs(chunks(t, edited))
+	changed := 0
+	for id := range after {
+		if !before[id] {
+			changed++
+		}
+	}
+	if changed == 0 || changed > 2 {
+		t.Errorf("%d of %d chunks changed, want the chunks around the insert", changed, len(after))
+	}
+}
+
+func TestChunkerSmall(t *testing.T) {
+	for _, n := range []int{0, 1, minChunkSize, minChunkSize + 1} {
+		data := randomBytes(t, n)
+		got := chunks(t, data)
+		if !bytes.Equal(bytes.Join(got, nil), data) {
+			t.Errorf("%d bytes: chunks do not add up to the content", n)
+		}
+		if n > 0 && len(got) != 1 {
+			t.Errorf("%d bytes: got %d chunks, want 1", n, len(got))
+		}
+	}
+}
+
+// storedChunks returns the number of chunks stored by c.
+func storedChunks(t *testing.T, c *Chunked) int {
+	t.Helper()
+	n := 0
+	if err := c.Storage.List(chunksFolder, func(Object) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func testChunked(t *testing.T) (*Chunked, *Local) {
+	t.Helper()
+	base, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewChunked(base), base
+}
+
+func TestChunkedRoundTrip(t *testing.T) {
+	c, _ := testChunked(t)
+
+	for _, n := range []int{0, 1, 3 << 20} {
+		data := randomBytes(t, n)
+		if err := c.Put("a/file", bytes.NewReader(data), Metadata{MetaSum: "sum"}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readAll(c, "a/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("content of %d bytes changed", n)
+		}
+		obj, err := c.Stat("a/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Size != int64(n) || obj.Sum() != "sum" {
+			t.Errorf("stat = %d bytes, sum %q, want %d bytes, sum", obj.Size, obj.Sum(), n)
+		}
+	}
+
+	var names []string
+	if err := c.List("", func(obj Object) error {
+		names = append(names, obj.Name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "a/file" {
+		t.Errorf("names = %q, want [a/file], the chunks are not listed", names)
+	}
+}
+
+func TestChunkedDedup(t *testing.T) {
+	c, _ := testChunked(t)
+	data := randomBytes(t, 16<<20)
+	if err := c.Put("file", bytes.NewReader(data), nil); err != nil {
+		t.Fatal(err)
+	}
+	stored := storedChunks(t, c)
+
+	if err := c.Put("copy", bytes.NewReader(data), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := storedChunks(t, c); n != stored {
+		t.Errorf("copy stored %d chunks, want none", n-stored)
+	}
+
+	edited := append([]byte{}, data...)
+	copy(edited[len(edited)/2:], "edited")
+	if err := c.Put("file", bytes.NewReader(edited), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := storedChunks(t, c) - stored; n == 0 || n > 2 {
+		t.Errorf("partial edit stored %d chunks, want the changed chunks", n)
+	}
+	if got, err := readAll(c, "file"); err != nil || !bytes.Equal(got, edited) {
+		t.Errorf("edited content changed, %v", err)
+	}
+}
+
+func TestChunkedPlain(t *testing.T) {
+	c, base := testChunked(t)
+	if err := base.Put("plain", strings.NewReader("stored before"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readAll(c, "plain"); err != nil || string(got) != "stored before" {
+		t.Errorf("content = %q, %v, want stored before", got, err)
+	}
+}
+
+func TestChunkedCorrupted(t *testing.T) {
+	c, base := testChunked(t)
+	if err := c.Put("file", bytes.NewReader(randomBytes(t, 1<<20)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var chunk string
+	if err := base.List(chunksFolder, func(obj Object) error {
+		chunk = obj.Name
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(base.path(chunk), []byte("corrupted"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAll(c, "file"); err == nil {
+		t.Error("corrupted chunk read")
+	}
+}
+
+func TestChunkedCollect(t *testing.T) {
+	grace := collectGrace
+	collectGrace = 0
+	defer func() { collectGrace = grace }()
+
+	c, _ := testChunked(t)
+	kept, dropped := randomBytes(t, 1<<20), randomBytes(t, 1<<20)
+	if err := c.Put("kept", bytes.NewReader(kept), nil); err != nil {
+		t.Fatal(err)
+	}
+	want := storedChunks(t, c)
+	if err := c.Put("dropped", bytes.NewReader(dropped), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("dropped"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Collect(NewVersioned(c, config.VersioningConfig{})); err != nil {
+		t.Fatal(err)
+	}
+	if n := storedChunks(t, c); n != want {
+		t.Errorf("%d chunks stored after the collection, want %d", n, want)
+	}
+	if got, err := readAll(c, "kept"); err != nil || !bytes.Equal(got, kept) {
+		t.Errorf("kept content changed, %v", err)
+	}
+
+	// a put after the collection stores the collected chunk again
+	if err := c.Put("dropped", bytes.NewReader(dropped), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readAll(c, "dropped"); err != nil || !bytes.Equal(got, dropped) {
+		t.Errorf("content stored after the collection changed, %v", err)
+	}
+	if _, err := c.Stat("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat of a missing object = %v, want not exist", err)
+	}
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"io"
+)
+
+// Content defined chunking with a gear rolling hash: a chunk ends where the
+// top bits of the hash are zero, so an insert or a removal only changes the
+// chunks around it and the rest of the file deduplicates.
+const (
+	minChunkSize = 512 << 10
+	avgChunkBits = 20 // 1 MiB average chunk size
+	maxChunkSize = 8 << 20
+
+	chunkMask = uint64(1<<avgChunkBits-1) << (64 - avgChunkBits)
+)
+
+// gear random values of the rolling hash, generated from a fixed seed so the
+// chunk boundaries never change between runs.
+var gear = func() (table [256]uint64) {
+	seed := uint64(0x77617463686f67) // "watchgo"
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	n   int
+	eof bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, maxChunkSize)}
+}
+
+// next returns the next chunk, it is only valid until the following call.
+func (c *chunker) next() ([]byte, error) {
+	for !c.eof && c.n < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.n:])
+		c.n += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	cut := c.n
+	if c.n > minChunkSize {
+		var h uint64
+		for i := minChunkSize; i < c.n; i++ {
+			h = (h << 1) + gear[c.buf[i]]
+			if h&chunkMask == 0 {
+				cut = i + 1
+				break
+			}
+		}
+	}
+
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf[:cut])
+	c.n = copy(c.buf, c.buf[cut:c.n])
+	return chunk, nil
+}
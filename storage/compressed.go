@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// MetaCodec is the metadata key of the codec an object is compressed with.
+const MetaCodec = "codec"
+
+// codec is a stream compression format.
+type codec struct {
+	writer func(w io.Writer, level int) (io.WriteCloser, error)
+	reader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]codec{
+	"gzip": {
+		writer: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				level = gzip.DefaultCompression
+			}
+			return gzip.NewWriterLevel(w, level)
+		},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	"zstd": {
+		writer: func(w io.Writer, level int) (io.WriteCloser, error) {
+			encLevel := zstd.SpeedDefault
+			if level > 0 {
+				encLevel = zstd.EncoderLevelFromZstd(level)
+			}
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(encLevel))
+		},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	},
+}
+
+// ValidCodec reports whether name is a supported codec.
+func ValidCodec(name string) bool {
+	_, ok := codecs[name]
+	return ok
+}
+
+// Compressed compresses an object with the codec named in its metadata, the
+// codec is kept in the metadata so Open decompresses it again. Without encode
+// objects are stored as they are and only decompressed.
+type Compressed struct {
+	Storage
+	level  int
+	encode bool
+}
+
+// NewCompressed wraps store, level 0 is the default level of each codec.
+func NewCompressed(store Storage, level int) *Compressed {
+	return &Compressed{Storage: store, level: level, encode: true}
+}
+
+// NewDecompressed wraps store which objects are stored uncompressed, the
+// objects compressed before are still decompressed.
+func NewDecompressed(store Storage) *Compressed {
+	return &Compressed{Storage: store}
+}
+
+func (c *Compressed) Unwrap() Storage {
+	return c.Storage
+}
+
+// Rename moves the object as it is stored, it is not decompressed.
+func (c *Compressed) Rename(oldName, newName string) error {
+	return Move(c.Storage, oldName, newName)
+}
+
+func (c *Compressed) Put(name string, r io.Reader, meta Metadata) error {
+	codecName, ok := meta[MetaCodec]
+	if ok && !c.encode {
+		plain := make(Metadata, len(meta))
+		for k, v := range meta {
+			if k != MetaCodec {
+				plain[k] = v
+			}
+		}
+		return c.Storage.Put(name, r, plain)
+	}
+	if !ok || codecName == "" {
+		return c.Storage.Put(name, r, meta)
+	}
+	cd, ok := codecs[codecName]
+	if !ok {
+		return fmt.Errorf("unknown codec %q", codecName)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		zw, err := cd.writer(pw, c.level)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(zw, r); err != nil {
+			_ = zw.Close()
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(zw.Close())
+	}()
+
+	err := c.Storage.Put(name, pr, meta)
+	_ = pr.CloseWithError(err)
+	return err
+}
+
+// Open decompresses an object stored with a codec.
+func (c *Compressed) Open(name string) (io.ReadCloser, error) {
+	obj, err := c.Storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := c.Storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	cd, ok := codecs[obj.Metadata[MetaCodec]]
+	if !ok {
+		return rc, nil
+	}
+	zr, err := cd.reader(rc)
+	if err != nil {
+		_ = rc.Close()
+		return nil, err
+	}
+	return &readCloser{Reader: zr, Closer: closers{zr, rc}}, nil
+}
+
+// closers closes every closer, the first error is returned.
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var err error
+	for _, c := range cs {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,469 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/hinha/watchgo/config"
+)
+
+// keyObject keeps the key derivation parameters of a destination, it is the
+// only object stored in plain text.
+const keyObject = ".encryption"
+
+// Encrypted objects start with encMagic followed by a random salt, the file
+// key is derived from the salt. The content is split into segments sealed
+// with AES-GCM, the nonce is the segment counter plus a flag marking the last
+// segment, so reordered or truncated content fails to decrypt.
+const (
+	encMagic       = "WGENC\x00\x01\x00"
+	encSegmentSize = 64 << 10
+	encSaltSize    = 16
+	encHeaderSize  = len(encMagic) + encSaltSize
+	encOverhead    = 16 // GCM tag
+)
+
+// MetaEncrypted holds the sealed metadata of an encrypted object.
+const MetaEncrypted = "enc"
+
+// keyParams is the content of the key object.
+type keyParams struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt,omitempty"`
+	N       int    `json:"n,omitempty"`
+	R       int    `json:"r,omitempty"`
+	P       int    `json:"p,omitempty"`
+	Check   []byte `json:"check"`
+}
+
+// Encrypted seals the content and metadata of every object with AES-256-GCM.
+// Object names can be encrypted too, every path segment is sealed with a
+// nonce derived from the segment, so the same name always gives the same
+// encrypted name. Objects stored before encryption was enabled are only read
+// as they are with allowPlain, a plain object could be planted otherwise.
+type Encrypted struct {
+	Storage
+
+	allowPlain bool
+	content    cipher.AEAD
+	fileKey    []byte
+	names      cipher.AEAD
+	nameIV     []byte
+}
+
+// NewEncrypted wraps store, the key is read from the key file or derived
+// from the passphrase file of cfg.
+func NewEncrypted(store Storage, cfg config.EncryptionConfig) (*Encrypted, error) {
+	master, err := masterKey(store, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Encrypted{Storage: store, allowPlain: cfg.AllowPlain, fileKey: subKey(master, "file")}
+	if e.content, err = newGCM(subKey(master, "meta")); err != nil {
+		return nil, err
+	}
+	if cfg.EncryptNames {
+		if e.names, err = newGCM(subKey(master, "name")); err != nil {
+			return nil, err
+		}
+		e.nameIV = subKey(master, "name-iv")
+	}
+	return e, nil
+}
+
+func (e *Encrypted) Unwrap() Storage {
+	return e.Storage
+}
+
+// masterKey loads the key object of store or creates it on first use.
+func masterKey(store Storage, cfg config.EncryptionConfig) ([]byte, error) {
+	var secret []byte
+	var kdf string
+	switch {
+	case cfg.KeyFile != "":
+		data, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < 32 {
+			return nil, fmt.Errorf("key file %s is shorter than 32 bytes", cfg.KeyFile)
+		}
+		secret, kdf = data, "key"
+	case cfg.PassphraseFile != "":
+		data, err := os.ReadFile(cfg.PassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		secret, kdf = bytes.TrimRight(data, "\r\n"), "scrypt"
+	default:
+		return nil, fmt.Errorf("encryption needs a key_file or passphrase_file")
+	}
+
+	var params keyParams
+	rc, err := store.Open(keyObject)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		params = keyParams{Version: 1, KDF: kdf}
+		if kdf == "scrypt" {
+			params.N, params.R, params.P = 1<<15, 8, 1
+			params.Salt = make([]byte, encSaltSize)
+			if _, err := rand.Read(params.Salt); err != nil {
+				return nil, err
+			}
+		}
+	case err != nil:
+		return nil, err
+	default:
+		err = json.NewDecoder(rc).Decode(&params)
+		_ = rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", keyObject, err)
+		}
+		if params.KDF != kdf {
+			return nil, fmt.Errorf("destination is encrypted with a %s, not a %s", params.KDF, kdf)
+		}
+	}
+
+	var master []byte
+	if kdf == "scrypt" {
+		if master, err = scrypt.Key(secret, params.Salt, params.N, params.R, params.P, 32); err != nil {
+			return nil, err
+		}
+	} else {
+		sum := sha256.Sum256(secret)
+		master = sum[:]
+	}
+
+	check := subKey(master, "check")
+	if params.Check == nil {
+		params.Check = check
+		data, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		if err := store.Put(keyObject, bytes.NewReader(data), nil); err != nil {
+			return nil, err
+		}
+	} else if !hmac.Equal(params.Check, check) {
+		return nil, fmt.Errorf("wrong encryption key for %s", store)
+	}
+	return master, nil
+}
+
+func subKey(master []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte("watchgo " + purpose))
+	return mac.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptName seals every segment of name, internal objects keep their name.
+func (e *Encrypted) encryptName(name string) string {
+	if e.names == nil || name == "" || name == keyObject {
+		return name
+	}
+
+	parts := strings.Split(path.Clean("/" + name)[1:], "/")
+	for i, part := range parts {
+		mac := hmac.New(sha256.New, e.nameIV)
+		mac.Write([]byte(part))
+		nonce := mac.Sum(nil)[:e.names.NonceSize()]
+		parts[i] = base64.RawURLEncoding.EncodeToString(e.names.Seal(nonce, nonce, []byte(part), nil))
+	}
+	return strings.Join(parts, "/")
+}
+
+// decryptName opens the segments of name, ok is false for a plain name.
+func (e *Encrypted) decryptName(name string) (string, bool) {
+	if e.names == nil {
+		return name, true
+	}
+
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		data, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil || len(data) < e.names.NonceSize() {
+			return name, false
+		}
+		nonce := data[:e.names.NonceSize()]
+		plain, err := e.names.Open(nil, nonce, data[len(nonce):], nil)
+		if err != nil {
+			return name, false
+		}
+		parts[i] = string(plain)
+	}
+	return strings.Join(parts, "/"), true
+}
+
+func (e *Encrypted) sealMeta(meta Metadata) (Metadata, error) {
+	if len(meta) == 0 {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, e.content.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := e.content.Seal(nonce, nonce, data, nil)
+	return Metadata{MetaEncrypted: base64.RawStdEncoding.EncodeToString(sealed)}, nil
+}
+
+func (e *Encrypted) openMeta(meta Metadata) Metadata {
+	sealed, ok := meta[MetaEncrypted]
+	if !ok {
+		// plain metadata, the checksum of a planted object is not trusted
+		if e.allowPlain {
+			return meta
+		}
+		return nil
+	}
+
+	data, err := base64.RawStdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < e.content.NonceSize() {
+		return nil
+	}
+	nonce := data[:e.content.NonceSize()]
+	plain, err := e.content.Open(nil, nonce, data[len(nonce):], nil)
+	if err != nil {
+		return nil
+	}
+
+	var opened Metadata
+	if json.Unmarshal(plain, &opened) != nil {
+		return nil
+	}
+	return opened
+}
+
+// object maps an object of the wrapped destination, the size is the size of
+// the plain content.
+func (e *Encrypted) object(obj Object, name string) Object {
+	obj.Name = name
+	obj.Metadata = e.openMeta(obj.Metadata)
+	if n := obj.Size - int64(encHeaderSize); n >= encOverhead {
+		segments := (n + encSegmentSize + encOverhead - 1) / (encSegmentSize + encOverhead)
+		obj.Size = n - segments*encOverhead
+	}
+	return obj
+}
+
+func (e *Encrypted) Put(name string, r io.Reader, meta Metadata) error {
+	sealed, err := e.sealMeta(meta)
+	if err != nil {
+		return err
+	}
+
+	salt := make([]byte, encSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := e.aead(salt)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(encrypt(pw, r, aead, salt))
+	}()
+	err = e.Storage.Put(e.encryptName(name), pr, sealed)
+	_ = pr.CloseWithError(err)
+	return err
+}
+
+func (e *Encrypted) aead(salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, e.fileKey)
+	mac.Write(salt)
+	return newGCM(mac.Sum(nil))
+}
+
+func segmentNonce(aead cipher.AEAD, counter uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func encrypt(w io.Writer, r io.Reader, aead cipher.AEAD, salt []byte) error {
+	if _, err := w.Write(append([]byte(encMagic), salt...)); err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(r, encSegmentSize)
+	buf := make([]byte, encSegmentSize)
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		// only the end of r is the last segment, a failed read must not
+		// store truncated content which decrypts
+		_, peek := br.Peek(1)
+		if peek != nil && peek != io.EOF {
+			return peek
+		}
+		last := err != nil || peek != nil
+		if _, err := w.Write(aead.Seal(nil, segmentNonce(aead, counter, last), buf[:n], nil)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// stored returns the name the object is stored under, an object stored
+// before names were encrypted keeps its plain name.
+func (e *Encrypted) stored(name string) string {
+	encName := e.encryptName(name)
+	if encName == name {
+		return name
+	}
+	if _, err := e.Storage.Stat(encName); errors.Is(err, fs.ErrNotExist) {
+		if _, err := e.Storage.Stat(name); err == nil {
+			return name
+		}
+	}
+	return encName
+}
+
+func (e *Encrypted) Stat(name string) (Object, error) {
+	obj, err := e.Storage.Stat(e.stored(name))
+	if err != nil {
+		return Object{}, err
+	}
+	return e.object(obj, name), nil
+}
+
+// List skips the key object, names which can not be decrypted are listed as
+// they are.
+func (e *Encrypted) List(prefix string, fn func(Object) error) error {
+	return e.Storage.List(e.encryptName(prefix), func(obj Object) error {
+		if obj.Name == keyObject {
+			return nil
+		}
+		name, _ := e.decryptName(obj.Name)
+		return fn(e.object(obj, name))
+	})
+}
+
+func (e *Encrypted) Delete(name string) error {
+	return e.Storage.Delete(e.stored(name))
+}
+
+func (e *Encrypted) Rename(oldName, newName string) error {
+	renamer, ok := e.Storage.(Renamer)
+	if !ok {
+		return fmt.Errorf("rename is not supported by %s", e.Storage)
+	}
+	return renamer.Rename(e.stored(oldName), e.encryptName(newName))
+}
+
+// Open decrypts the object, content stored without encryption is returned
+// as it is with allowPlain and fails otherwise.
+func (e *Encrypted) Open(name string) (io.ReadCloser, error) {
+	rc, err := e.Storage.Open(e.stored(name))
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReaderSize(rc, encSegmentSize+encOverhead)
+	head, _ := br.Peek(encHeaderSize)
+	if !bytes.HasPrefix(head, []byte(encMagic)) || len(head) < encHeaderSize {
+		if e.allowPlain {
+			return &readCloser{Reader: br, Closer: rc}, nil
+		}
+		_ = rc.Close()
+		return nil, fmt.Errorf("%s is not encrypted, set encryption.allow_plain to read objects stored before encryption", name)
+	}
+	_, _ = br.Discard(encHeaderSize)
+
+	aead, err := e.aead(head[len(encMagic):])
+	if err != nil {
+		_ = rc.Close()
+		return nil, err
+	}
+	return &decryptReader{r: br, c: rc, aead: aead, buf: make([]byte, encSegmentSize+encOverhead)}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// decryptReader opens the segments of an encrypted object one by one.
+type decryptReader struct {
+	r       *bufio.Reader
+	c       io.Closer
+	aead    cipher.AEAD
+	buf     []byte
+	plain   []byte
+	counter uint64
+	done    bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(d.r, d.buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		_, peek := d.r.Peek(1)
+		last := err != nil || peek != nil
+		plain, err := d.aead.Open(d.buf[:0], segmentNonce(d.aead, d.counter, last), d.buf[:n], nil)
+		if err != nil {
+			return 0, fmt.Errorf("decrypt segment %d: %w", d.counter, err)
+		}
+		d.plain, d.done = plain, last
+		d.counter++
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.c.Close()
+}
@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hinha/watchgo/config"
+)
+
+// testEncrypted returns an encrypted destination on a local destination in a
+// temporary folder, secret is written to the key file.
+func testEncrypted(t *testing.T, secret []byte) (*Encrypted, *Local, config.EncryptionConfig) {
+	t.Helper()
+	base, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.EncryptionConfig{Enabled: true, KeyFile: writeTemp(t, secret)}
+	e, err := NewEncrypted(base, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, base, cfg
+}
+
+func writeTemp(t *testing.T, data []byte) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func readAll(store Storage, name string) ([]byte, error) {
+	rc, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	e, base, _ := testEncrypted(t, randomBytes(t, 32))
+
+	for _, n := range []int{0, 1, encSegmentSize - 1, encSegmentSize, encSegmentSize + 1, 3*encSegmentSize + 5} {
+		data := randomBytes(t, n)
+		meta := Metadata{MetaSum: "sum"}
+		if err := e.Put("a/file", bytes.NewReader(data), meta); err != nil {
+			t.Fatalf("put %d bytes: %v", n, err)
+		}
+
+		got, err := readAll(e, "a/file")
+		if err != nil {
+			t.Fatalf("open %d bytes: %v", n, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("content of %d bytes changed", n)
+		}
+
+		obj, err := e.Stat("a/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Size != int64(n) {
+			t.Errorf("size = %d, want %d", obj.Size, n)
+		}
+		if obj.Sum() != "sum" {
+			t.Errorf("sum = %q, want sum", obj.Sum())
+		}
+
+		stored, err := readAll(base, "a/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 0 && bytes.Contains(stored, data) {
+			t.Error("content stored in plain text")
+		}
+	}
+}
+
+func TestEncryptedNames(t *testing.T) {
+	base, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.EncryptionConfig{Enabled: true, KeyFile: writeTemp(t, randomBytes(t, 32)), EncryptNames: true}
+	e, err := NewEncrypted(base, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Put("photos/secret.jpg", strings.NewReader("content"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := base.Stat("photos/secret.jpg"); err == nil {
+		t.Error("name stored in plain text")
+	}
+
+	var names []string
+	if err := e.List("photos", func(obj Object) error {
+		names = append(names, obj.Name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "photos/secret.jpg" {
+		t.Errorf("names = %q, want [photos/secret.jpg]", names)
+	}
+}
+
+// segments returns the sealed segments of the stored object data.
+func segments(data []byte) [][]byte {
+	var segs [][]byte
+	for body := data[encHeaderSize:]; len(body) > 0; {
+		n := encSegmentSize + encOverhead
+		if n > len(body) {
+			n = len(body)
+		}
+		segs = append(segs, body[:n])
+		body = body[n:]
+	}
+	return segs
+}
+
+func TestEncryptedTampered(t *testing.T) {
+	e, base, _ := testEncrypted(t, randomBytes(t, 32))
+	if err := e.Put("file", bytes.NewReader(randomBytes(t, 3*encSegmentSize+5)), nil); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := readAll(base, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	segs := segments(stored)
+	header := stored[:encHeaderSize]
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(append([][]byte{header}, parts...), nil)
+	}
+
+	flipped := append([]byte{}, stored...)
+	flipped[encHeaderSize+10] ^= 1
+	salt := append([]byte{}, stored...)
+	salt[len(encMagic)] ^= 1
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "flipped bit", data: flipped},
+		{name: "changed salt", data: salt},
+		{name: "last segment removed", data: join(segs[0], segs[1], segs[2])},
+		{name: "truncated segment", data: stored[:len(stored)-3]},
+		{name: "header only", data: header},
+		{name: "reordered segments", data: join(segs[1], segs[0], segs[2], segs[3])},
+		{name: "duplicated segment", data: join(segs[0], segs[0], segs[1], segs[2], segs[3])},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := base.Put("file", bytes.NewReader(tt.data), nil); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readAll(e, "file"); err == nil {
+				t.Error("tampered content decrypted")
+			}
+		})
+	}
+}
+
+func TestEncryptedWrongKey(t *testing.T) {
+	_, base, _ := testEncrypted(t, randomBytes(t, 32))
+	cfg := config.EncryptionConfig{Enabled: true, KeyFile: writeTemp(t, randomBytes(t, 32))}
+	if _, err := NewEncrypted(base, cfg); err == nil {
+		t.Error("wrong key accepted")
+	}
+}
+
+func TestEncryptedWrongPassphrase(t *testing.T) {
+	base, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.EncryptionConfig{Enabled: true, PassphraseFile: writeTemp(t, []byte("correct horse\n"))}
+	e, err := NewEncrypted(base, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Put("file", strings.NewReader("content"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the trailing newline of the passphrase file is ignored
+	cfg.PassphraseFile = writeTemp(t, []byte("correct horse"))
+	if e, err = NewEncrypted(base, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readAll(e, "file"); err != nil || string(got) != "content" {
+		t.Fatalf("content = %q, %v", got, err)
+	}
+
+	cfg.PassphraseFile = writeTemp(t, []byte("battery staple"))
+	if _, err := NewEncrypted(base, cfg); err == nil {
+		t.Error("wrong passphrase accepted")
+	}
+
+	cfg = config.EncryptionConfig{Enabled: true, KeyFile: writeTemp(t, randomBytes(t, 32))}
+	if _, err := NewEncrypted(base, cfg); err == nil {
+		t.Error("key file accepted for a passphrase destination")
+	}
+}
+
+func TestEncryptedPlain(t *testing.T) {
+	e, base, cfg := testEncrypted(t, randomBytes(t, 32))
+	if err := base.Put("plain", strings.NewReader("planted"), Metadata{MetaSum: "sum"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readAll(e, "plain"); err == nil {
+		t.Error("plain object opened without allow_plain")
+	}
+	obj, err := e.Stat("plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Sum() != "" {
+		t.Errorf("plain sum %q trusted without allow_plain", obj.Sum())
+	}
+
+	cfg.AllowPlain = true
+	e, err = NewEncrypted(base, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readAll(e, "plain"); err != nil || string(got) != "planted" {
+		t.Errorf("content = %q, %v, want planted", got, err)
+	}
+	if obj, err := e.Stat("plain"); err != nil || obj.Sum() != "sum" {
+		t.Errorf("sum = %q, %v, want sum", obj.Sum(), err)
+	}
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestEncryptedSourceError(t *testing.T) {
+	e, _, _ := testEncrypted(t, randomBytes(t, 32))
+	if err := e.Put("file", strings.NewReader("previous"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	r := io.MultiReader(bytes.NewReader(randomBytes(t, encSegmentSize+1)), errReader{os.ErrPermission})
+	if err := e.Put("file", r, nil); err == nil {
+		t.Fatal("source read error ignored")
+	}
+	if got, err := readAll(e, "file"); err != nil || string(got) != "previous" {
+		t.Errorf("content = %q, %v, want previous", got, err)
+	}
+}
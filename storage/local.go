@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/hinha/watchgo/config"
+)
+
+// Local stores backups in a directory of the local filesystem, usually a
+// mounted hard drive. Metadata is kept in json sidecar files.
+type Local struct {
+	root string
+}
+
+// NewLocal returns a local destination rooted at the static backup folder
+// inside drivePath.
+func NewLocal(drivePath string) (*Local, error) {
+	root := filepath.Join(drivePath, config.GetStaticBackupFolder())
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &Local{root: root}, nil
+}
+
+func (l *Local) path(name string) string {
+	return filepath.Join(l.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (l *Local) Put(name string, r io.Reader, meta Metadata) error {
+	if err := l.write(l.path(name), func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	metaPath := l.path(metaName(name))
+	if len(meta) == 0 {
+		if err := os.Remove(metaPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return l.write(metaPath, func(w io.Writer) error {
+		return writeMeta(w, meta)
+	})
+}
+
+// write writes into a temporary file which is renamed once complete, so an
+// interrupted write never replaces a previous backup.
+func (l *Local) write(dstPath string, fn func(w io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		return err
+	}
+	tmpDir := l.path(tmpFolder)
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(tmpDir, "")
+	if err != nil {
+		return err
+	}
+	if err := fn(tmp); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dstPath); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (l *Local) meta(name string) Metadata {
+	f, err := os.Open(l.path(metaName(name)))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	meta, _ := readMeta(f)
+	return meta
+}
+
+func (l *Local) Stat(name string) (Object, error) {
+	fi, err := os.Stat(l.path(name))
+	if err != nil {
+		return Object{}, err
+	}
+	if !fi.Mode().IsRegular() {
+		return Object{}, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return Object{Name: name, Size: fi.Size(), ModTime: fi.ModTime(), Metadata: l.meta(name)}, nil
+}
+
+// List walks the folder, the metadata sidecar and temporary folders are
+// skipped.
+func (l *Local) List(prefix string, fn func(Object) error) error {
+	metaPath, tmpPath := l.path(metaFolder), l.path(tmpFolder)
+	err := filepath.Walk(l.path(prefix), func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && (p == metaPath || p == tmpPath) {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		return fn(Object{Name: name, Size: info.Size(), ModTime: info.ModTime(), Metadata: l.meta(name)})
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (l *Local) Delete(name string) error {
+	if err := l.remove(l.path(name)); err != nil {
+		return err
+	}
+	if err := l.remove(l.path(metaName(name))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// remove deletes filePath and its empty parent folders, the root is kept.
+func (l *Local) remove(filePath string) error {
+	if err := os.Remove(filePath); err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(filePath)
+	for dir != l.root && strings.HasPrefix(dir, l.root) {
+		if os.Remove(dir) != nil {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return nil
+}
+
+func (l *Local) Rename(oldName, newName string) error {
+	if err := l.rename(l.path(oldName), l.path(newName)); err != nil {
+		return err
+	}
+
+	err := l.rename(l.path(metaName(oldName)), l.path(metaName(newName)))
+	if errors.Is(err, fs.ErrNotExist) {
+		// no metadata, drop a stale sidecar of the new name
+		_ = os.Remove(l.path(metaName(newName)))
+		return nil
+	}
+	return err
+}
+
+func (l *Local) rename(oldPath, newPath string) error {
+	if _, err := os.Stat(oldPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+func (l *Local) Open(name string) (io.ReadCloser, error) {
+	return os.Open(l.path(name))
+}
+
+func (l *Local) String() string {
+	return "local:" + l.root
+}
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"encoding/json"
+	"io"
+	"path"
+)
+
+// metaFolder keeps the metadata of destinations without native support for
+// it, every object has a json sidecar at the same relative path.
+const metaFolder = ".meta"
+
+// tmpFolder keeps the writes in progress of destinations without atomic
+// writes, a backup name never starts with it.
+const tmpFolder = ".tmp"
+
+func metaName(name string) string {
+	return path.Join(metaFolder, path.Clean("/"+name)) + ".json"
+}
+
+func writeMeta(w io.Writer, meta Metadata) error {
+	return json.NewEncoder(w).Encode(meta)
+}
+
+func readMeta(r io.Reader) (Metadata, error) {
+	var meta Metadata
+	if err := json.NewDecoder(r).Decode(&meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"github.com/hinha/watchgo/config"
+)
+
+// defaultPartSize multipart upload part size in megabytes.
+const defaultPartSize = 64
+
+// S3 stores backups in a bucket of an S3 compatible object storage such as
+// AWS S3 or MinIO. Metadata is kept as x-amz-meta-* headers of the object.
+type S3 struct {
+	client   *minio.Client
+	bucket   string
+	prefix   string
+	partSize uint64
+}
+
+// NewS3 connects to the configured endpoint and creates the bucket if it
+// does not exist yet.
+func NewS3(cfg config.S3Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 endpoint and bucket are required")
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
+			return nil, err
+		}
+	}
+
+	partSize := cfg.PartSize
+	if partSize == 0 {
+		partSize = defaultPartSize
+	}
+
+	return &S3{
+		client:   client,
+		bucket:   cfg.Bucket,
+		prefix:   strings.Trim(cfg.Prefix, "/"),
+		partSize: partSize << 20,
+	}, nil
+}
+
+func (s *S3) key(name string) string {
+	return strings.TrimPrefix(path.Join(s.prefix, path.Clean("/"+name)), "/")
+}
+
+func (s *S3) name(key string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(key, s.prefix), "/")
+}
+
+// Put uploads r, files larger than the part size are sent as multipart upload.
+func (s *S3) Put(name string, r io.Reader, meta Metadata) error {
+	size := int64(-1)
+	if f, ok := r.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil {
+			size = fi.Size()
+		}
+	}
+
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.key(name), r, size, minio.PutObjectOptions{
+		UserMetadata: meta,
+		PartSize:     s.partSize,
+		ContentType:  "application/octet-stream",
+	})
+	return err
+}
+
+func (s *S3) Stat(name string) (Object, error) {
+	info, err := s.client.StatObject(context.Background(), s.bucket, s.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		return Object{}, s.error("stat", name, err)
+	}
+	return s.object(info), nil
+}
+
+// List walks the objects below prefix. Object metadata is only part of the
+// listing on MinIO, other providers fall back to a HEAD request per object.
+func (s *S3) List(prefix string, fn func(Object) error) error {
+	keyPrefix := s.key(prefix)
+	if keyPrefix != "" {
+		keyPrefix += "/"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for info := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:       keyPrefix,
+		Recursive:    true,
+		WithMetadata: true,
+	}) {
+		if info.Err != nil {
+			return info.Err
+		}
+		if strings.HasSuffix(info.Key, "/") {
+			continue
+		}
+
+		obj := s.object(info)
+		if obj.Sum() == "" {
+			if stat, err := s.Stat(obj.Name); err == nil {
+				obj = stat
+			}
+		}
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3) Delete(name string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, s.key(name), minio.RemoveObjectOptions{})
+}
+
+// Rename copies the object on the server side, metadata included.
+func (s *S3) Rename(oldName, newName string) error {
+	ctx := context.Background()
+	_, err := s.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucket, Object: s.key(newName)},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: s.key(oldName)})
+	if err != nil {
+		return s.error("rename", oldName, err)
+	}
+	return s.client.RemoveObject(ctx, s.bucket, s.key(oldName), minio.RemoveObjectOptions{})
+}
+
+func (s *S3) Open(name string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s.error("open", name, err)
+	}
+	// GetObject is lazy, stat it to report missing objects right away
+	if _, err := obj.Stat(); err != nil {
+		_ = obj.Close()
+		return nil, s.error("open", name, err)
+	}
+	return obj, nil
+}
+
+func (s *S3) String() string {
+	return fmt.Sprintf("s3:%s/%s", s.bucket, s.prefix)
+}
+
+func (s *S3) object(info minio.ObjectInfo) Object {
+	meta := make(Metadata, len(info.UserMetadata))
+	for k, v := range info.UserMetadata {
+		k = strings.TrimPrefix(strings.ToLower(k), "x-amz-meta-")
+		meta[k] = v
+	}
+	return Object{
+		Name:     s.name(info.Key),
+		Size:     info.Size,
+		ModTime:  info.LastModified,
+		Metadata: meta,
+	}
+}
+
+// error maps a missing object onto fs.ErrNotExist.
+func (s *S3) error(op, name string, err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return err
+}
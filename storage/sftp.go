@@ -0,0 +1,373 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/hinha/watchgo/config"
+)
+
+// SFTP stores backups on a remote host over SSH. Connections are kept in a
+// pool shared by the workers and re-dialed after a failure.
+type SFTP struct {
+	addr   string
+	client *ssh.ClientConfig
+	root   string
+	pool   chan *sftpConn
+}
+
+type sftpConn struct {
+	ssh  *ssh.Client
+	sftp *sftp.Client
+}
+
+func (c *sftpConn) close() {
+	_ = c.sftp.Close()
+	_ = c.ssh.Close()
+}
+
+// NewSFTP returns a remote destination, files are stored in the static backup
+// folder inside the configured path. maxConns defaults to the number of
+// workers.
+func NewSFTP(cfg config.SFTPConfig) (*SFTP, error) {
+	if cfg.Host == "" || cfg.Path == "" {
+		return nil, fmt.Errorf("sftp host and path are required")
+	}
+
+	var auth []ssh.AuthMethod
+	if cfg.PrivateKey != "" {
+		key, err := os.ReadFile(cfg.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("parse private key %s: %w", cfg.PrivateKey, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		auth = append(auth, ssh.Password(cfg.Password))
+	}
+
+	hostKey := ssh.InsecureIgnoreHostKey()
+	if !cfg.InsecureIgnoreHostKey {
+		knownHosts := cfg.KnownHosts
+		if knownHosts == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			knownHosts = path.Join(home, ".ssh", "known_hosts")
+		}
+
+		var err error
+		if hostKey, err = knownhosts.New(knownHosts); err != nil {
+			return nil, err
+		}
+	}
+
+	port := cfg.Port
+	if port == 0 {
+		port = 22
+	}
+	maxConns := cfg.MaxConns
+	if maxConns <= 0 {
+		maxConns = config.General.Worker
+	}
+	if maxConns <= 0 {
+		maxConns = 1
+	}
+
+	s := &SFTP{
+		addr: net.JoinHostPort(cfg.Host, strconv.Itoa(port)),
+		client: &ssh.ClientConfig{
+			User:            cfg.User,
+			Auth:            auth,
+			HostKeyCallback: hostKey,
+		},
+		root: path.Join(cfg.Path, config.GetStaticBackupFolder()),
+		pool: make(chan *sftpConn, maxConns),
+	}
+	for i := 0; i < maxConns; i++ {
+		s.pool <- nil
+	}
+
+	// dial once to report a wrong configuration at start
+	conn, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	err = conn.sftp.MkdirAll(s.root)
+	s.release(conn, err)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// acquire takes a connection from the pool, dialing it when needed.
+func (s *SFTP) acquire() (*sftpConn, error) {
+	conn := <-s.pool
+	if conn != nil {
+		return conn, nil
+	}
+
+	client, err := ssh.Dial("tcp", s.addr, s.client)
+	if err != nil {
+		s.pool <- nil
+		return nil, err
+	}
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		_ = client.Close()
+		s.pool <- nil
+		return nil, err
+	}
+	return &sftpConn{ssh: client, sftp: sc}, nil
+}
+
+// release gives the connection back to the pool. The connection is dropped
+// when err is not caused by the remote file, the next acquire re-dials it.
+func (s *SFTP) release(conn *sftpConn, err error) {
+	var status *sftp.StatusError
+	if err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.As(err, &status) {
+		conn.close()
+		conn = nil
+	}
+	s.pool <- conn
+}
+
+func (s *SFTP) path(name string) string {
+	return path.Join(s.root, path.Clean("/"+name))
+}
+
+// Put writes into a temporary file which is renamed once complete, so an
+// interrupted upload never replaces a previous backup.
+func (s *SFTP) Put(name string, r io.Reader, meta Metadata) (err error) {
+	conn, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer func() { s.release(conn, err) }()
+
+	dstPath := s.path(name)
+	if err := conn.sftp.MkdirAll(path.Dir(dstPath)); err != nil {
+		return err
+	}
+
+	tmpPath, err := s.tempPath(conn)
+	if err != nil {
+		return err
+	}
+	if err := s.write(conn, tmpPath, r); err != nil {
+		_ = conn.sftp.Remove(tmpPath)
+		return err
+	}
+	if err := s.rename(conn, tmpPath, dstPath); err != nil {
+		_ = conn.sftp.Remove(tmpPath)
+		return err
+	}
+
+	metaPath := s.path(metaName(name))
+	if len(meta) == 0 {
+		// a stale sidecar of the replaced object
+		_, err := conn.sftp.Lstat(metaPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return conn.sftp.Remove(metaPath)
+	}
+	if err := conn.sftp.MkdirAll(path.Dir(metaPath)); err != nil {
+		return err
+	}
+	f, err := conn.sftp.Create(metaPath)
+	if err != nil {
+		return err
+	}
+	if err := writeMeta(f, meta); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// tempPath returns a random name in the temporary folder.
+func (s *SFTP) tempPath(conn *sftpConn) (string, error) {
+	dir := s.path(tmpFolder)
+	if err := conn.sftp.MkdirAll(dir); err != nil {
+		return "", err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return path.Join(dir, hex.EncodeToString(b)), nil
+}
+
+func (s *SFTP) write(conn *sftpConn, filePath string, r io.Reader) error {
+	f, err := conn.sftp.Create(filePath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.ReadFrom(r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *SFTP) Stat(name string) (obj Object, err error) {
+	conn, err := s.acquire()
+	if err != nil {
+		return Object{}, err
+	}
+	defer func() { s.release(conn, err) }()
+
+	fi, err := conn.sftp.Stat(s.path(name))
+	if err != nil {
+		return Object{}, err
+	}
+	if !fi.Mode().IsRegular() {
+		return Object{}, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return Object{Name: name, Size: fi.Size(), ModTime: fi.ModTime(), Metadata: s.meta(conn, name)}, nil
+}
+
+// List walks the remote tree, the metadata sidecar and temporary folders are
+// skipped.
+func (s *SFTP) List(prefix string, fn func(Object) error) (err error) {
+	conn, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer func() { s.release(conn, err) }()
+
+	metaPath, tmpPath := s.path(metaFolder), s.path(tmpFolder)
+	walker := conn.sftp.Walk(s.path(prefix))
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+
+		fi := walker.Stat()
+		if fi.IsDir() && (walker.Path() == metaPath || walker.Path() == tmpPath) {
+			walker.SkipDir()
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		name := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), s.root), "/")
+		obj := Object{Name: name, Size: fi.Size(), ModTime: fi.ModTime(), Metadata: s.meta(conn, name)}
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SFTP) meta(conn *sftpConn, name string) Metadata {
+	f, err := conn.sftp.Open(s.path(metaName(name)))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	meta, _ := readMeta(f)
+	return meta
+}
+
+func (s *SFTP) Delete(name string) (err error) {
+	conn, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer func() { s.release(conn, err) }()
+
+	if err := conn.sftp.Remove(s.path(name)); err != nil {
+		return err
+	}
+	_ = conn.sftp.Remove(s.path(metaName(name)))
+	return nil
+}
+
+func (s *SFTP) Rename(oldName, newName string) (err error) {
+	conn, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer func() { s.release(conn, err) }()
+
+	if err := s.rename(conn, s.path(oldName), s.path(newName)); err != nil {
+		return err
+	}
+
+	oldMeta, newMeta := s.path(metaName(oldName)), s.path(metaName(newName))
+	if _, err := conn.sftp.Stat(oldMeta); err != nil {
+		return nil
+	}
+	return s.rename(conn, oldMeta, newMeta)
+}
+
+func (s *SFTP) rename(conn *sftpConn, oldPath, newPath string) error {
+	if err := conn.sftp.MkdirAll(path.Dir(newPath)); err != nil {
+		return err
+	}
+	if err := conn.sftp.PosixRename(oldPath, newPath); err != nil {
+		// server without the posix-rename extension
+		_ = conn.sftp.Remove(newPath)
+		return conn.sftp.Rename(oldPath, newPath)
+	}
+	return nil
+}
+
+// Open keeps the connection until the returned reader is closed.
+func (s *SFTP) Open(name string) (io.ReadCloser, error) {
+	conn, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := conn.sftp.Open(s.path(name))
+	if err != nil {
+		s.release(conn, err)
+		return nil, err
+	}
+	return &sftpFile{File: f, release: func(err error) { s.release(conn, err) }}, nil
+}
+
+func (s *SFTP) String() string {
+	return fmt.Sprintf("sftp:%s@%s%s", s.client.User, s.addr, s.root)
+}
+
+type sftpFile struct {
+	*sftp.File
+	release func(err error)
+}
+
+func (f *sftpFile) Close() error {
+	err := f.File.Close()
+	f.release(err)
+	return err
+}
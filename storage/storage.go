@@ -0,0 +1,135 @@
+// Package storage implements the destinations a backup is written to.
+package storage
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+)
+
+// MetaSum is the metadata key holding the SHA-1 sum of the source file.
+const MetaSum = "sha1"
+
+// MetaFormat and MetaOriginalFormat are the metadata keys of an image stored
+// in another format than its source, e.g. "webp" and "jpeg".
+const (
+	MetaFormat         = "format"
+	MetaOriginalFormat = "original_format"
+)
+
+// previewsFolder keeps the compressed previews of images which are stored as
+// the original bytes.
+const previewsFolder = ".previews"
+
+// PreviewName returns the name of the preview of the object name.
+func PreviewName(name string) string {
+	return path.Join(previewsFolder, path.Clean("/"+name))
+}
+
+// IsPreview reports whether name is a preview.
+func IsPreview(name string) bool {
+	return strings.HasPrefix(name, previewsFolder+"/")
+}
+
+// ThumbsFolder keeps the JPEG thumbnails of the backed up images.
+const ThumbsFolder = ".thumbs"
+
+// ThumbName returns the name of the thumbnail of the object name.
+func ThumbName(name string) string {
+	return path.Join(ThumbsFolder, path.Clean("/"+name)) + ".jpg"
+}
+
+// IsThumb reports whether name is a thumbnail.
+func IsThumb(name string) bool {
+	return strings.HasPrefix(name, ThumbsFolder+"/")
+}
+
+// IsDerived reports whether name is derived from another object, a preview
+// or a thumbnail.
+func IsDerived(name string) bool {
+	return IsPreview(name) || IsThumb(name)
+}
+
+// Metadata is stored next to an object by destinations supporting it.
+type Metadata map[string]string
+
+// Object describes a single file stored in a destination.
+type Object struct {
+	Name     string
+	Size     int64
+	ModTime  time.Time
+	Metadata Metadata
+}
+
+// Sum returns the SHA-1 sum of the source file recorded when the object was
+// stored, or an empty string if the destination did not keep it.
+func (o Object) Sum() string {
+	return o.Metadata[MetaSum]
+}
+
+// Storage is a backup destination. Object names are slash separated and
+// relative to the root of the destination, e.g. "Downloads/foo/bar.jpg".
+type Storage interface {
+	// Put stores the content of r under name, replacing any previous object.
+	Put(name string, r io.Reader, meta Metadata) error
+	// Stat returns the object stored under name.
+	Stat(name string) (Object, error)
+	// List calls fn for every object stored below prefix.
+	List(prefix string, fn func(Object) error) error
+	// Delete removes the object stored under name.
+	Delete(name string) error
+	// Open returns a reader for the object stored under name.
+	Open(name string) (io.ReadCloser, error)
+
+	fmt.Stringer
+}
+
+// New returns the storage of a configured destination.
+func New(cfg config.DestinationConfig) (Storage, error) {
+	store, err := open(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Encryption.Enabled {
+		if store, err = NewEncrypted(store, cfg.Encryption); err != nil {
+			return nil, err
+		}
+	}
+
+	switch cfg.Format {
+	case "", "plain":
+	case "chunked":
+		store = NewChunked(store)
+	default:
+		return nil, fmt.Errorf("unknown repository format %q", cfg.Format)
+	}
+
+	if cfg.Versioning.Enabled {
+		store = NewVersioned(store, cfg.Versioning)
+	}
+
+	// objects compressed by an earlier configuration are still decompressed,
+	// a compressed stream would change after every edit and defeat the
+	// deduplication of the chunks
+	if cfg.Format == "chunked" {
+		return NewDecompressed(store), nil
+	}
+	return NewCompressed(store, config.FileSystemCfg.Compress.Files.Level), nil
+}
+
+func open(cfg config.DestinationConfig) (Storage, error) {
+	switch cfg.Type {
+	case "", "local":
+		return NewLocal(cfg.HardDrivePath)
+	case "s3":
+		return NewS3(cfg.S3)
+	case "sftp":
+		return NewSFTP(cfg.SFTP)
+	}
+	return nil, fmt.Errorf("unknown backup type %q", cfg.Type)
+}
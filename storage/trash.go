@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+// trashFolder keeps the backups of removed files, a trashed object is stored
+// as .trash/<name>/<timestamp>.
+const trashFolder = ".trash"
+
+// TrashName returns the name of the object name trashed at t.
+func TrashName(name string, t time.Time) string {
+	return path.Join(trashFolder, path.Clean("/"+name), t.UTC().Format(revisionLayout))
+}
+
+// IsTrash reports whether name is a trashed object.
+func IsTrash(name string) bool {
+	return strings.HasPrefix(name, trashFolder+"/")
+}
+
+// EmptyTrash deletes the objects of store trashed before t.
+func EmptyTrash(store Storage, before time.Time) error {
+	var expired []string
+	err := store.List(trashFolder, func(obj Object) error {
+		trashed, err := time.Parse(revisionLayout, path.Base(obj.Name))
+		if err == nil && trashed.Before(before) {
+			expired = append(expired, obj.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range expired {
+		if err := store.Delete(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+)
+
+// versionsFolder keeps the previous revisions of every object, a revision is
+// stored as .versions/<name>/<timestamp>.
+const versionsFolder = ".versions"
+
+// revisionLayout timestamp of a revision name, it sorts chronologically.
+const revisionLayout = "20060102T150405.000000000Z"
+
+// Renamer is implemented by destinations which can move an object without
+// copying its content through the client.
+type Renamer interface {
+	Rename(oldName, newName string) error
+}
+
+// Move renames the object oldName of store to newName. A store which is not
+// a Renamer copies the object and deletes the old one.
+func Move(store Storage, oldName, newName string) error {
+	if renamer, ok := store.(Renamer); ok {
+		return renamer.Rename(oldName, newName)
+	}
+
+	obj, err := store.Stat(oldName)
+	if err != nil {
+		return err
+	}
+	rc, err := store.Open(oldName)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := store.Put(newName, rc, obj.Metadata); err != nil {
+		return err
+	}
+	return store.Delete(oldName)
+}
+
+// Revision is a stored version of an object.
+type Revision struct {
+	Object
+	Time    time.Time
+	Current bool
+}
+
+// Versioner is implemented by destinations keeping revisions.
+type Versioner interface {
+	// Revisions returns the revisions of name, newest first. The current
+	// object is the first one.
+	Revisions(name string) ([]Revision, error)
+	// History calls fn for the name of every object below prefix having a
+	// current object or revisions.
+	History(prefix string, fn func(name string) error) error
+}
+
+// AsVersioner returns the Versioner of store or of the destination it wraps,
+// the names of its revisions are opened through store.
+func AsVersioner(store Storage) (Versioner, bool) {
+	for store != nil {
+		if versioner, ok := store.(Versioner); ok {
+			return versioner, true
+		}
+		unwrapper, ok := store.(Unwrapper)
+		if !ok {
+			return nil, false
+		}
+		store = unwrapper.Unwrap()
+	}
+	return nil, false
+}
+
+// Versioned keeps the previous content of an object as revision whenever it
+// is replaced, revisions are pruned by the retention policy.
+type Versioned struct {
+	Storage
+	retention config.VersioningConfig
+}
+
+// NewVersioned wraps store with a versioned layout.
+func NewVersioned(store Storage, retention config.VersioningConfig) *Versioned {
+	return &Versioned{Storage: store, retention: retention}
+}
+
+func (v *Versioned) Unwrap() Storage {
+	return v.Storage
+}
+
+func revisionPrefix(name string) string {
+	return path.Join(versionsFolder, path.Clean("/"+name))
+}
+
+// Put moves the current object to a revision before it is replaced. An
+// object with the same source sum is replaced without a revision.
+func (v *Versioned) Put(name string, r io.Reader, meta Metadata) error {
+	// a preview or thumbnail is derived from its object, which has the revisions
+	if IsDerived(name) {
+		return v.Storage.Put(name, r, meta)
+	}
+
+	cur, err := v.Storage.Stat(name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	case cur.Sum() != "" && cur.Sum() == meta[MetaSum]:
+	default:
+		if err := v.revision(cur); err != nil {
+			return err
+		}
+	}
+
+	if err := v.Storage.Put(name, r, meta); err != nil {
+		return err
+	}
+	return v.prune(name)
+}
+
+// revision moves the current object obj to a revision of its name.
+func (v *Versioned) revision(obj Object) error {
+	revName := path.Join(revisionPrefix(obj.Name), obj.ModTime.UTC().Format(revisionLayout))
+	return Move(v.Storage, obj.Name, revName)
+}
+
+// Rename moves the current object, its revisions stay with oldName. An object
+// replaced at newName is kept as revision.
+func (v *Versioned) Rename(oldName, newName string) error {
+	if IsDerived(newName) {
+		return Move(v.Storage, oldName, newName)
+	}
+
+	cur, err := v.Storage.Stat(newName)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := v.revision(cur); err != nil {
+			return err
+		}
+	}
+
+	if err := Move(v.Storage, oldName, newName); err != nil {
+		return err
+	}
+	return v.prune(newName)
+}
+
+// List skips the revisions, only current objects are listed.
+func (v *Versioned) List(prefix string, fn func(Object) error) error {
+	return v.Storage.List(prefix, func(obj Object) error {
+		if strings.HasPrefix(obj.Name, versionsFolder+"/") {
+			return nil
+		}
+		return fn(obj)
+	})
+}
+
+func (v *Versioned) Revisions(name string) ([]Revision, error) {
+	var revs []Revision
+	if cur, err := v.Storage.Stat(name); err == nil {
+		revs = append(revs, Revision{Object: cur, Time: cur.ModTime, Current: true})
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	var old []Revision
+	prefix := revisionPrefix(name)
+	err := v.Storage.List(prefix, func(obj Object) error {
+		if path.Dir(obj.Name) != prefix {
+			return nil
+		}
+		t, err := time.Parse(revisionLayout, path.Base(obj.Name))
+		if err != nil {
+			return nil
+		}
+		old = append(old, Revision{Object: obj, Time: t})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(old, func(i, j int) bool { return old[i].Time.After(old[j].Time) })
+	return append(revs, old...), nil
+}
+
+func (v *Versioned) History(prefix string, fn func(name string) error) error {
+	seen := make(map[string]bool)
+	err := v.List(prefix, func(obj Object) error {
+		seen[obj.Name] = true
+		return fn(obj.Name)
+	})
+	if err != nil {
+		return err
+	}
+
+	return v.Storage.List(revisionPrefix(prefix), func(obj Object) error {
+		name := strings.TrimPrefix(path.Dir(obj.Name), versionsFolder+"/")
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+		return fn(name)
+	})
+}
+
+// prune deletes the revisions of name outside the retention policy. The
+// current object is always kept and is not counted.
+func (v *Versioned) prune(name string) error {
+	if v.retention.KeepLast == 0 && v.retention.KeepDaily == 0 && v.retention.KeepMonthly == 0 {
+		return nil
+	}
+
+	revs, err := v.Revisions(name)
+	if err != nil {
+		return err
+	}
+
+	for _, rev := range expired(revs, v.retention, time.Now()) {
+		if err := v.Storage.Delete(rev.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expired returns the revisions not kept by the retention policy: the newest
+// keep_last revisions, the newest revision of each of the last keep_daily days
+// and the newest revision of each of the last keep_monthly months.
+func expired(revs []Revision, retention config.VersioningConfig, now time.Time) []Revision {
+	days := make(map[string]bool)
+	months := make(map[string]bool)
+	dayLimit := now.AddDate(0, 0, -retention.KeepDaily)
+	monthLimit := now.AddDate(0, -retention.KeepMonthly, 0)
+
+	var drop []Revision
+	n := 0
+	for _, rev := range revs {
+		if rev.Current {
+			continue
+		}
+		n++
+
+		t := rev.Time.Local()
+		day, month := t.Format("2006-01-02"), t.Format("2006-01")
+
+		keep := n <= retention.KeepLast
+		if retention.KeepDaily > 0 && t.After(dayLimit) && !days[day] {
+			days[day] = true
+			keep = true
+		}
+		if retention.KeepMonthly > 0 && t.After(monthLimit) && !months[month] {
+			months[month] = true
+			keep = true
+		}
+
+		if !keep {
+			drop = append(drop, rev)
+		}
+	}
+	return drop
+}
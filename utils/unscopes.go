@@ -39,6 +39,7 @@ var allowedExtension = []string{
 	"apk", "jar", "exec", "osx", "ps1", "sh", "bat", "cmd", "app", "dmg", "pkg", "rpm", "deb", "msp", "ocx", "cpl", "sys", "drv", "com", "msi", "dll", "exe",
 	// image
 	"jpeg", "psp", "tiff", "tga", "cr2", "CR2", "psd", "ico", "sct", "pxr", "pct", "pic", "raw", "jpe", "tif", "png", "bmp", "jpg", "gif",
+	"heic", "heif", "webp", "avif", "cr3", "nef", "nrw", "arw", "srf", "sr2", "dng", "orf", "rw2", "raf", "pef", "srw", "x3f",
 	// document
 	"maf", "mpt", "xltx", "pptm", "ott", "ots", "otp", "txt", "pptx", "mat", "mar", "maq", "oti", "otf", "otg", "otc", "vdx", "ppt", "vssm", "xlsm", "xls", "vsdx", "xlt", "xts", "xlsx", "rtf", "ppl", "doc", "mam", "vsdm", "oft", "slk", "ppsm", "xps", "vtx", "odb", "dif", "docm", "onetoc", "xsn", "and", "docx",
 	"xltm", "one", "pot", "thmx", "vsd", "oth", "vsl", "vsw", "vst", "vss", "vsx", "adp", "accdr", "accdt", "odf", "accdb", "accde", "ppam", "potm", "odm", "odi", "dot", "odg", "sldm", "dotm", "odc", "msg", "vssx", "dotx", "odt", "ods", "odp", "sldx", "mdt", "mdw", "vstm", "onetoc2", "pub", "mde", "mdf", "vstx",